@@ -1,10 +1,14 @@
 package aws
 
 import (
+	"log"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 )
 
@@ -16,34 +20,113 @@ type CredentialConfig struct {
 	Profile   string
 	Filename  string
 	Token     string
+
+	// RoleARNs are assumed in turn after RoleARN, each from the credentials
+	// of the previous role, e.g. to reach an account only trusting a hub
+	// account role.
+	RoleARNs []string
+
+	// RoleExternalID and RoleSessionName are passed to STS when assuming
+	// each role.
+	RoleExternalID  string
+	RoleSessionName string
+
+	// IMDSv2 requires the token based EC2 instance metadata service (IMDSv2)
+	// instead of falling back to IMDSv1 when retrieving instance profile
+	// credentials.
+	IMDSv2 bool
+	// IMDSEndpoint overrides the EC2 instance metadata service endpoint.
+	IMDSEndpoint string
+
+	// SharedConfig loads the shared config file (~/.aws/config) in addition
+	// to the shared credentials file, so that the region, role chaining and
+	// SSO settings of Profile, or of the AWS_PROFILE environment variable,
+	// are honored.
+	SharedConfig bool
+
+	// UseFIPSEndpoint resolves the FIPS endpoints of STS when assuming roles.
+	UseFIPSEndpoint bool
 }
 
 func (c *CredentialConfig) Credentials() client.ConfigProvider {
-	if c.RoleARN != "" {
+	if len(c.roleARNs()) > 0 {
 		return c.assumeCredentials()
 	} else {
 		return c.rootCredentials()
 	}
 }
 
+// MetadataRegion returns the region of the EC2 instance running the agent
+// from the instance metadata service.
+func (c *CredentialConfig) MetadataRegion() (string, error) {
+	return ec2metadata.New(c.session(c.config())).Region()
+}
+
 func (c *CredentialConfig) rootCredentials() client.ConfigProvider {
-	config := &aws.Config{
-		Region: aws.String(c.Region),
-	}
+	config := c.config()
 	if c.AccessKey != "" || c.SecretKey != "" {
 		config.Credentials = credentials.NewStaticCredentials(c.AccessKey, c.SecretKey, c.Token)
-	} else if c.Profile != "" || c.Filename != "" {
+	} else if c.Filename != "" || (c.Profile != "" && !c.SharedConfig) {
+		// with shared config, the session resolves the credentials of the
+		// profile itself as they may not be static
 		config.Credentials = credentials.NewSharedCredentials(c.Filename, c.Profile)
 	}
 
-	return session.New(config)
+	return c.session(config)
 }
 
 func (c *CredentialConfig) assumeCredentials() client.ConfigProvider {
-	rootCredentials := c.rootCredentials()
+	configProvider := c.rootCredentials()
+	for _, roleARN := range c.roleARNs() {
+		config := c.config()
+		config.Credentials = stscreds.NewCredentials(configProvider, roleARN, func(p *stscreds.AssumeRoleProvider) {
+			if c.RoleExternalID != "" {
+				p.ExternalID = aws.String(c.RoleExternalID)
+			}
+			if c.RoleSessionName != "" {
+				p.RoleSessionName = c.RoleSessionName
+			}
+		})
+		configProvider = c.session(config)
+	}
+	return configProvider
+}
+
+// roleARNs returns the roles to assume in order.
+func (c *CredentialConfig) roleARNs() []string {
+	if c.RoleARN == "" {
+		return c.RoleARNs
+	}
+	return append([]string{c.RoleARN}, c.RoleARNs...)
+}
+
+func (c *CredentialConfig) config() *aws.Config {
 	config := &aws.Config{
 		Region: aws.String(c.Region),
 	}
-	config.Credentials = stscreds.NewCredentials(rootCredentials, c.RoleARN)
-	return session.New(config)
+	if c.IMDSv2 {
+		config.EC2MetadataEnableFallback = aws.Bool(false)
+	}
+	if c.UseFIPSEndpoint {
+		config.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	return config
+}
+
+func (c *CredentialConfig) session(config *aws.Config) client.ConfigProvider {
+	options := session.Options{
+		Config:          *config,
+		EC2IMDSEndpoint: c.IMDSEndpoint,
+	}
+	if c.SharedConfig {
+		options.Profile = c.Profile
+		options.SharedConfigState = session.SharedConfigEnable
+	}
+
+	sess, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		log.Printf("E! Error creating AWS session, using defaults: %s", err)
+		return session.New(config)
+	}
+	return sess
 }
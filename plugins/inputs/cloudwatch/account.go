@@ -0,0 +1,26 @@
+package cloudwatch
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+type stsClient interface {
+	GetCallerIdentityWithContext(aws.Context, *sts.GetCallerIdentityInput, ...request.Option) (*sts.GetCallerIdentityOutput, error)
+}
+
+/*
+ * Resolve the id of the AWS account the credentials belong to
+ */
+func (c *CloudWatch) fetchAccountID() error {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+
+	resp, err := c.stsc.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return err
+	}
+	c.accountID = aws.StringValue(resp.Account)
+	return nil
+}
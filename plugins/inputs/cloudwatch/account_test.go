@@ -0,0 +1,81 @@
+package cloudwatch
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockStsClient struct {
+	calls int
+	err   error
+}
+
+func (m *mockStsClient) GetCallerIdentityWithContext(ctx aws.Context, params *sts.GetCallerIdentityInput, opts ...request.Option) (*sts.GetCallerIdentityOutput, error) {
+	m.calls++
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &sts.GetCallerIdentityOutput{Account: aws.String("123456789012")}, nil
+}
+
+func TestGatherAccountIDTag(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:       "us-east-1",
+		Namespace:    "AWS/ELB",
+		Delay:        internalDuration,
+		Period:       internalDuration,
+		RateLimit:    10,
+		AccountIDTag: true,
+	}
+
+	var acc testutil.Accumulator
+	client := &mockStsClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+	c.stsc = client
+
+	assert.NoError(t, c.Gather(&acc))
+	assert.NoError(t, c.Gather(&acc))
+
+	// the account id is only resolved once
+	assert.Equal(t, 1, client.calls)
+	for _, m := range acc.Metrics {
+		assert.Equal(t, "123456789012", m.Tags["account_id"])
+	}
+}
+
+func TestGatherAccountIDError(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:       "us-east-1",
+		Namespace:    "AWS/ELB",
+		Delay:        internalDuration,
+		Period:       internalDuration,
+		RateLimit:    10,
+		AccountIDTag: true,
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+	c.stsc = &mockStsClient{err: errors.New("access denied")}
+
+	// metrics are still gathered, without the tag
+	assert.NoError(t, c.Gather(&acc))
+	assert.True(t, acc.HasMeasurement("cloudwatch_aws_elb"))
+	_, ok := acc.Metrics[0].Tags["account_id"]
+	assert.False(t, ok)
+}
@@ -0,0 +1,76 @@
+package cloudwatch
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+type (
+	// ClientFuncs implements the CloudWatch client of the plugin with a
+	// function per request it makes, e.g. to fake only some requests in
+	// tests. The functions take and return the aws-sdk-go types, so a client
+	// of another SDK must be wrapped by converting its inputs and outputs to
+	// them. The request options of aws-sdk-go are not passed on, and a
+	// request whose function is not set fails.
+	ClientFuncs struct {
+		ListMetrics         func(context.Context, *cloudwatch.ListMetricsInput) (*cloudwatch.ListMetricsOutput, error)
+		GetMetricStatistics func(context.Context, *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error)
+		GetMetricData       func(context.Context, *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error)
+	}
+
+	// Ec2ClientFuncs implements the EC2 client of the plugin as ClientFuncs
+	// do, its DescribeInstances requests fetching the tags of
+	// 'enrich_ec2_tags'.
+	Ec2ClientFuncs struct {
+		DescribeInstances func(context.Context, *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+	}
+)
+
+// SetClientFuncs sets the CloudWatch client of given region as SetClient
+// does, from the functions implementing its requests.
+func (c *CloudWatch) SetClientFuncs(region string, funcs *ClientFuncs) {
+	c.injectClient(region, funcs)
+}
+
+// SetEc2ClientFuncs sets the EC2 client of given region as SetEc2Client
+// does, from the functions implementing its requests.
+func (c *CloudWatch) SetEc2ClientFuncs(region string, funcs *Ec2ClientFuncs) {
+	c.injectEc2Client(region, funcs)
+}
+
+func (f *ClientFuncs) ListMetricsWithContext(ctx aws.Context, params *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
+	if f.ListMetrics == nil {
+		return nil, unsupportedRequest("ListMetrics")
+	}
+	return f.ListMetrics(ctx, params)
+}
+
+func (f *ClientFuncs) GetMetricStatisticsWithContext(ctx aws.Context, params *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	if f.GetMetricStatistics == nil {
+		return nil, unsupportedRequest("GetMetricStatistics")
+	}
+	return f.GetMetricStatistics(ctx, params)
+}
+
+func (f *ClientFuncs) GetMetricDataWithContext(ctx aws.Context, params *cloudwatch.GetMetricDataInput, opts ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	if f.GetMetricData == nil {
+		return nil, unsupportedRequest("GetMetricData")
+	}
+	return f.GetMetricData(ctx, params)
+}
+
+func (f *Ec2ClientFuncs) DescribeInstancesWithContext(ctx aws.Context, params *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	if f.DescribeInstances == nil {
+		return nil, unsupportedRequest("DescribeInstances")
+	}
+	return f.DescribeInstances(ctx, params)
+}
+
+func unsupportedRequest(name string) error {
+	return fmt.Errorf("%s requests are not implemented by the client functions", name)
+}
@@ -0,0 +1,56 @@
+package cloudwatch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetClientFuncs(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:        "us-east-1",
+		Namespace:     "AWS/EBS",
+		Delay:         internalDuration,
+		Period:        internalDuration,
+		RateLimit:     10,
+		EnrichEc2Tags: true,
+		Ec2TagKeys:    []string{"Name"},
+
+		Ec2TagCacheTTL: internal.Duration{Duration: time.Hour},
+	}
+
+	mock := &mockInstanceCloudWatchClient{}
+	c.SetClientFuncs("us-east-1", &ClientFuncs{
+		ListMetrics: func(ctx context.Context, params *cloudwatch.ListMetricsInput) (*cloudwatch.ListMetricsOutput, error) {
+			return mock.ListMetricsWithContext(ctx, params)
+		},
+		GetMetricStatistics: func(ctx context.Context, params *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+			return mock.GetMetricStatisticsWithContext(ctx, params)
+		},
+	})
+	ec2Mock := &mockEc2Client{}
+	c.SetEc2ClientFuncs("us-east-1", &Ec2ClientFuncs{
+		DescribeInstances: func(ctx context.Context, params *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+			return ec2Mock.DescribeInstancesWithContext(ctx, params)
+		},
+	})
+
+	var acc testutil.Accumulator
+	assert.NoError(t, c.Gather(&acc))
+	assert.Len(t, acc.Metrics, 1)
+	assert.Equal(t, "db-1", acc.Metrics[0].Tags["Name"])
+
+	// requests without a function are not supported
+	c.UseGetMetricData = true
+	assert.Error(t, c.Gather(&acc))
+}
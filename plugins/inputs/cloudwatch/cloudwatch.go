@@ -1,73 +1,448 @@
 package cloudwatch
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/sts"
 
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/filter"
 	"github.com/influxdata/telegraf/internal"
 	internalaws "github.com/influxdata/telegraf/internal/config/aws"
 	"github.com/influxdata/telegraf/internal/errchan"
 	"github.com/influxdata/telegraf/internal/limiter"
 	"github.com/influxdata/telegraf/plugins/inputs"
+	"github.com/influxdata/telegraf/selfstat"
 )
 
 type (
 	CloudWatch struct {
-		Region    string `toml:"region"`
-		AccessKey string `toml:"access_key"`
-		SecretKey string `toml:"secret_key"`
-		RoleARN   string `toml:"role_arn"`
-		Profile   string `toml:"profile"`
-		Filename  string `toml:"shared_credential_file"`
-		Token     string `toml:"token"`
-
-		Period      internal.Duration `toml:"period"`
-		Delay       internal.Duration `toml:"delay"`
-		Namespace   string            `toml:"namespace"`
-		Metrics     []*Metric         `toml:"metrics"`
-		CacheTTL    internal.Duration `toml:"cache_ttl"`
-		RateLimit   int               `toml:"ratelimit"`
-		client      cloudwatchClient
-		metricCache *MetricCache
+		Region    string   `toml:"region"`
+		Regions   []string `toml:"regions"`
+		AccessKey string   `toml:"access_key"`
+		SecretKey string   `toml:"secret_key"`
+		RoleARN   string   `toml:"role_arn"`
+		Profile   string   `toml:"profile"`
+		Filename  string   `toml:"shared_credential_file"`
+		Token     string   `toml:"token"`
+
+		RoleARNs        []string `toml:"role_arns"`
+		RoleExternalID  string   `toml:"role_external_id"`
+		RoleSessionName string   `toml:"role_session_name"`
+
+		CredentialSets []*CredentialSet `toml:"credential_sets"`
+
+		IMDSv2       bool   `toml:"imds_v2"`
+		IMDSEndpoint string `toml:"imds_endpoint"`
+
+		SharedConfig bool `toml:"shared_config"`
+
+		EndpointURL     string `toml:"endpoint_url"`
+		UseFIPSEndpoint bool   `toml:"use_fips_endpoint"`
+		HTTPProxyURL    string `toml:"http_proxy_url"`
+
+		Period          internal.Duration `toml:"period"`
+		HighResolution  bool              `toml:"high_resolution"`
+		Delay           internal.Duration `toml:"delay"`
+		AlignPeriods    bool              `toml:"align_periods"`
+		Backfill        internal.Duration `toml:"backfill"`
+		Namespace       string            `toml:"namespace"`
+		Namespaces      []string          `toml:"namespaces"`
+		Metrics         []*Metric         `toml:"metrics"`
+		CacheTTL        internal.Duration `toml:"cache_ttl"`
+		RecentlyActive  bool              `toml:"recently_active"`
+		StrictDims      bool              `toml:"strict_dimensions"`
+		MetricCacheFile string            `toml:"metric_cache_file"`
+		RateLimit       int               `toml:"ratelimit"`
+		MaxConcurrent   int               `toml:"max_concurrent_requests"`
+		Timeout         internal.Duration `toml:"timeout"`
+		GatherJitter    internal.Duration `toml:"gather_jitter"`
+		DryRun          bool              `toml:"dry_run"`
+		Statistics      []string          `toml:"statistics"`
+
+		ExtendedStatistics []string `toml:"extended_statistics"`
+
+		ExcludeNames      []string     `toml:"exclude_names"`
+		ExcludeDimensions []*Dimension `toml:"exclude_dimensions"`
+
+		// ShardIndex and ShardTotal split the selected metrics between
+		// ShardTotal agents, this one gathering the ShardIndex-th shard
+		ShardIndex int `toml:"shard_index"`
+		ShardTotal int `toml:"shard_total"`
+
+		NamespaceStatistics map[string][]string `toml:"namespace_statistics"`
+		NamespaceDelays     map[string]string   `toml:"namespace_delays"`
+
+		Fill              string `toml:"fill"`
+		ZeroCounts        bool   `toml:"zero_counts"`
+		OnlyNewDatapoints bool   `toml:"only_new_datapoints"`
+
+		Measurement       string `toml:"measurement"`
+		MeasurementPrefix string `toml:"measurement_prefix"`
+		FieldNaming       string `toml:"field_naming"`
+
+		// StatisticLabels names the statistics in field names, and in the
+		// 'statistic' tag, instead of their snake cased name
+		StatisticLabels map[string]string `toml:"statistic_labels"`
+
+		// UnitLabels sets the 'unit' tag of the metrics of a unit instead of
+		// the snake cased unit
+		UnitLabels map[string]string `toml:"unit_labels"`
+
+		EmitRate       bool `toml:"emit_rate"`
+		PeriodTag      bool `toml:"period_tag"`
+		OmitUnitNone   bool `toml:"omit_unit_none"`
+		CountAsInt     bool `toml:"count_as_int"`
+		StatisticAsTag bool `toml:"statistic_as_tag"`
+		TimestampField bool `toml:"include_timestamp_field"`
+		AccountIDTag   bool `toml:"account_id_tag"`
+		OmitRegionTag  bool `toml:"omit_region_tag"`
+
+		UseGetMetricData bool     `toml:"use_get_metric_data"`
+		LinkedAccounts   bool     `toml:"include_linked_accounts"`
+		LabelTemplate    string   `toml:"label_template"`
+		EnrichEc2Tags    bool     `toml:"enrich_ec2_tags"`
+		Ec2TagKeys       []string `toml:"ec2_tag_keys"`
+		Ec2TagDimension  string   `toml:"ec2_tag_dimension"`
+
+		Ec2InstanceFilters []*Ec2InstanceFilter `toml:"ec2_instance_filters"`
+		Ec2TaggedOnly      bool                 `toml:"ec2_tagged_instances_only"`
+
+		Ec2TagCacheTTL        internal.Duration `toml:"ec2_tag_cache_ttl"`
+		Ec2TagRefreshInterval internal.Duration `toml:"ec2_tag_refresh_interval"`
+
+		EnrichRdsTags bool     `toml:"enrich_rds_tags"`
+		RdsTagKeys    []string `toml:"rds_tag_keys"`
+
+		EnrichResourceTags  bool     `toml:"enrich_resource_tags"`
+		ResourceTagKeys     []string `toml:"resource_tag_keys"`
+		ResourceTypeFilters []string `toml:"resource_type_filters"`
+
+		// ResourceTagFilters limits the metrics to the ones of the resources
+		// matching every filter
+		ResourceTagFilters []*ResourceTagFilter `toml:"resource_tag_filters"`
+
+		// SkipEmptyTags drops the EC2, RDS and resource tags of empty value
+		SkipEmptyTags bool `toml:"skip_empty_tags"`
+
+		TagRenames     []*TagRename     `toml:"tag_rename"`
+		TagDerivations []*TagDerivation `toml:"tag_derivations"`
+		MetricMath     []*MetricMath    `toml:"metric_math"`
+
+		// clients and caches are kept per region, the metric cache then
+		// per namespace
+		initialized         bool
+		clients             map[string]cloudwatchClient
+		ec2Clients          map[string]ec2Client
+		rdsClients          map[string]rdsClient
+		resourceTagsClients map[string]resourceTagsClient
+		stsc                stsClient
+		accountID           string
+		proxyURL            *url.URL
+		metricCache         map[string]map[string]*MetricCache
+		tagsCache           map[string]*TagCache
+		rdsTagsCache        map[string]*TagCache
+		resourceTagsCache   map[string]*TagCache
+		taggedResources     map[string]*taggedResources
+
+		// mu guards the metric cache, the state kept across gathers for each
+		// metric, the count of metrics without datapoints of a gather and
+		// whether a gather is running
+		mu             sync.Mutex
+		gathering      bool
+		lastDatapoints map[string]*cloudwatch.Datapoint
+		lastTimestamps map[string]time.Time
+		// the metrics returning no datapoints, by region
+		emptyMetrics map[string]int
+		emptyStats   map[string]selfstat.Stat
+
+		// stats are keyed by region, then namespace
+		stats map[string]map[string]*namespaceStats
+
+		// ctx is cancelled once the plugin is stopped, cancelling the
+		// requests in flight
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		// metadataRegion looks up the region of the EC2 instance, the
+		// instance metadata unless replaced, e.g. in tests
+		metadataRegion func() (string, error)
+
+		// credentialsExpired is set, under mu, once a request failed with
+		// expired credentials, renewing the clients after the gather
+		credentialsExpired bool
+
+		// injectedClients and injectedEc2Clients are the regions of the
+		// clients set with SetClient and SetEc2Client, which are not renewed
+		injectedClients    map[string]bool
+		injectedEc2Clients map[string]bool
+
+		// excludeNames is the compiled ExcludeNames filter
+		excludeNames filter.Filter
+
+		// namespaceDelays are the parsed NamespaceDelays
+		namespaceDelays map[string]time.Duration
+
+		// backfilled is set once the first gather requested the backfill
+		// timeframe
+		backfilled bool
 	}
 
 	Metric struct {
 		MetricNames []string     `toml:"names"`
+		NamesRegex  []string     `toml:"names_regex"`
+		ARN         string       `toml:"arn"`
 		Dimensions  []*Dimension `toml:"dimensions"`
+		Statistics  []string     `toml:"statistics"`
+
+		// DimensionSets splits the filter into one filter per set, each
+		// selecting the metrics having the Dimensions along with the ones of
+		// the set
+		DimensionSets []*DimensionSet `toml:"dimension_sets"`
+
+		ExtendedStatistics []string `toml:"extended_statistics"`
+
+		Period internal.Duration `toml:"period"`
+		Delay  internal.Duration `toml:"delay"`
+		Unit   string            `toml:"unit"`
+		Label  string            `toml:"label"`
+
+		// Measurement overrides the measurement name of the metrics of the
+		// filter
+		Measurement string `toml:"measurement"`
+
+		// AccountID selects the metrics of a single linked source account
+		AccountID string `toml:"account_id"`
+
+		// AnomalyBand is the width in standard deviations of the anomaly
+		// detection band pulled along with every statistic, if positive
+		AnomalyBand float64 `toml:"anomaly_band"`
+
+		namesRegex []*regexp.Regexp
+		arnRegion  string
 	}
 
 	Dimension struct {
 		Name  string `toml:"name"`
 		Value string `toml:"value"`
+
+		valueFilter filter.Filter
+	}
+
+	// DimensionSet is one of the dimension combinations of a Metric filter.
+	DimensionSet struct {
+		Dimensions []*Dimension `toml:"dimensions"`
+	}
+
+	// TagRename sets the value of the From dimension as the To tag, instead
+	// of the snake cased dimension name. From is either the dimension name or
+	// its snake cased form.
+	TagRename struct {
+		From string `toml:"from"`
+		To   string `toml:"to"`
+	}
+
+	// TagDerivation derives new tags from the capture groups of Pattern
+	// matched against the value of the Source tag, or from its parts split
+	// by Delimiter. The value of the n-th capture group or part is set as the
+	// n-th tag of Tags.
+	TagDerivation struct {
+		Source    string   `toml:"source"`
+		Pattern   string   `toml:"pattern"`
+		Delimiter string   `toml:"delimiter"`
+		Tags      []string `toml:"tags"`
+
+		regexp *regexp.Regexp
+	}
+
+	// statisticValue is the value of a statistic of a datapoint.
+	statisticValue struct {
+		statistic string
+		value     float64
+	}
+
+	// SelectedMetric is a CloudWatch metric of a region selected for
+	// gathering, along with the Metric filter that selected it. Filter is nil
+	// when gathering every metric of a namespace. AccountID is the source
+	// account of the metrics of linked accounts, empty otherwise.
+	SelectedMetric struct {
+		*cloudwatch.Metric
+		Region    string
+		AccountID string
+		Filter    *Metric
 	}
 
 	MetricCache struct {
 		TTL     time.Duration
 		Fetched time.Time
 		Metrics []*cloudwatch.Metric
+
+		// Accounts are the owning accounts of Metrics when listing the
+		// metrics of linked accounts, in the same order
+		Accounts []string
+
+		// fetched distinguishes a successful listing that returned no metrics
+		// from a cache that was never filled
+		fetched bool
 	}
 
+	// cloudwatchClient is the boundary of the CloudWatch requests made by the
+	// plugin, implemented by the aws-sdk-go clients and by ClientFuncs.
 	cloudwatchClient interface {
-		ListMetrics(*cloudwatch.ListMetricsInput) (*cloudwatch.ListMetricsOutput, error)
-		GetMetricStatistics(*cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error)
+		ListMetricsWithContext(aws.Context, *cloudwatch.ListMetricsInput, ...request.Option) (*cloudwatch.ListMetricsOutput, error)
+		GetMetricStatisticsWithContext(aws.Context, *cloudwatch.GetMetricStatisticsInput, ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error)
+		GetMetricDataWithContext(aws.Context, *cloudwatch.GetMetricDataInput, ...request.Option) (*cloudwatch.GetMetricDataOutput, error)
+	}
+
+	// metricDataQuery associates a GetMetricData query id with the metric and
+	// statistic it was built from.
+	metricDataQuery struct {
+		metric    *SelectedMetric
+		statistic string
+
+		// band is the id of the statistic query of which this query is the
+		// anomaly detection band, if any
+		band string
+	}
+
+	// metricsError is the error of a request of the given metrics, counted
+	// as failed by the summary error of a gather.
+	metricsError struct {
+		metrics []*SelectedMetric
+		err     error
+	}
+
+	// metricDataWindow is the region and timeframe of a GetMetricData
+	// request.
+	metricDataWindow struct {
+		region string
+		start  time.Time
+		end    time.Time
+	}
+
+	// metricDataBatch is a set of GetMetricData queries, keyed by query id,
+	// sent in a single request for the same region and timeframe.
+	metricDataBatch struct {
+		metricDataWindow
+		queries map[string]metricDataQuery
 	}
 )
 
+const (
+	// maxMetricDataQueries is the maximum number of queries allowed in a
+	// single GetMetricData request.
+	maxMetricDataQueries = 500
+
+	// maxStatisticsDatapoints is the maximum number of datapoints returned
+	// by a single GetMetricStatistics request.
+	maxStatisticsDatapoints = 1440
+
+	// maxExtendedStatistics is the maximum number of extended statistics
+	// allowed in a single GetMetricStatistics request.
+	maxExtendedStatistics = 10
+
+	// maxListDimensionFilters is the maximum number of dimension filters
+	// allowed in a single ListMetrics request.
+	maxListDimensionFilters = 10
+)
+
+// Field naming schemes of the 'field_naming' option.
+const (
+	fieldNamingMetricStatistic = "metric_statistic"
+	fieldNamingStatisticOnly   = "statistic_only"
+)
+
+// metricNameWildcard selects every metric name in the 'names' option.
+const metricNameWildcard = "*"
+
+// rateStatistic names the per second rate fields of the 'emit_rate' option.
+const rateStatistic = "rate"
+
+// labelTag is the tag of the 'label_template' option.
+const labelTag = "metric_label"
+
+// labelPropRegexp matches the ${PROP('...')} placeholders of a label template.
+var labelPropRegexp = regexp.MustCompile(`\$\{PROP\('([^']+)'\)\}`)
+
+// timestampField is the field of the 'include_timestamp_field' option.
+const timestampField = "cloudwatch_timestamp"
+
+// statisticValueField is the field of the points of the 'statistic_as_tag'
+// option.
+const statisticValueField = "value"
+
+// highResolutionPeriods are the sub-minute periods supported for high
+// resolution metrics.
+var highResolutionPeriods = []time.Duration{
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// percentileRegexp matches the extended statistics names, e.g. p99 or p99.9.
+var percentileRegexp = regexp.MustCompile(`^p\d{1,3}(\.\d+)?$`)
+
+// unsafeNamespaceRegexp matches the characters of a namespace that are not
+// safe in measurement names, e.g. slashes, spaces or colons.
+var unsafeNamespaceRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// underscoresRegexp matches the runs of underscores of a formatted namespace.
+var underscoresRegexp = regexp.MustCompile(`_{2,}`)
+
+// defaultStatistics are the statistics requested when none are configured.
+var defaultStatistics = []string{
+	cloudwatch.StatisticAverage,
+	cloudwatch.StatisticMaximum,
+	cloudwatch.StatisticMinimum,
+	cloudwatch.StatisticSum,
+	cloudwatch.StatisticSampleCount,
+}
+
+// expiredTokenCodes are the error codes of requests made with expired
+// credentials.
+var expiredTokenCodes = []string{"ExpiredToken", "ExpiredTokenException"}
+
 func (c *CloudWatch) SampleConfig() string {
 	return `
   ## Amazon Region
+  ## Defaults to the region of the EC2 instance running telegraf, from the
+  ## instance metadata, when neither 'region' nor 'regions' is set.
   region = "us-east-1"
 
+  ## Additional Amazon Regions to collect from the same instance (optional)
+  ## Metrics are tagged with the region they were collected from.
+  #regions = ["eu-west-1"]
+
   ## Amazon Credentials
   ## Credentials are loaded in the following order
-  ## 1) Assumed credentials via STS if role_arn is specified
+  ## 1) Assumed credentials via STS if role_arn or role_arns is specified
   ## 2) explicit credentials from 'access_key' and 'secret_key'
   ## 3) shared profile from 'profile'
   ## 4) environment variables
@@ -77,9 +452,54 @@ func (c *CloudWatch) SampleConfig() string {
   #secret_key = ""
   #token = ""
   #role_arn = ""
+  ## Roles assumed in turn after role_arn, each from the credentials of the
+  ## previous one (optional)
+  #role_arns = []
+  #role_external_id = ""
+  #role_session_name = ""
   #profile = ""
   #shared_credential_file = ""
 
+  ## Credentials CloudWatch requests are distributed across in turn, instead
+  ## of the credentials above, to spread them over the API quotas of several
+  ## principals of the same account (optional). Each set overrides the
+  ## credentials above with the fields it sets, its 'role_arn' replacing both
+  ## 'role_arn' and 'role_arns', and is picked 'weight' times as often as a
+  ## set of weight 1. EC2, RDS, tagging and STS requests still use the
+  ## credentials above.
+  #[[inputs.cloudwatch.credential_sets]]
+  #  role_arn = "arn:aws:iam::123456789012:role/telegraf-1"
+  #  weight = 2
+  #[[inputs.cloudwatch.credential_sets]]
+  #  role_arn = "arn:aws:iam::123456789012:role/telegraf-2"
+
+  ## Load the shared config file (~/.aws/config) so that the region, role
+  ## chaining and SSO settings of 'profile', or of the AWS_PROFILE environment
+  ## variable, are honored
+  #shared_config = false
+
+  ## Require the token based EC2 instance metadata service (IMDSv2) when using
+  ## instance profile credentials, optionally at a custom endpoint
+  #imds_v2 = false
+  #imds_endpoint = ""
+
+  ## Endpoint to make requests against, the correct endpoint is automatically
+  ## determined and this option should only be set if you wish to override the
+  ## default, e.g. for VPC endpoints or local testing.
+  ##   ex: endpoint_url = "http://localhost:4566"
+  #endpoint_url = ""
+
+  ## Use the FIPS endpoints of the CloudWatch, EC2, RDS, tagging and STS APIs
+  ## (optional), e.g. monitoring-fips.us-east-1.amazonaws.com, in the regions
+  ## providing them. Overridden by 'endpoint_url' when set.
+  #use_fips_endpoint = false
+
+  ## HTTP proxy to send the CloudWatch, EC2 and STS API requests through,
+  ## instead of the one set by the HTTP_PROXY and HTTPS_PROXY environment
+  ## variables. Only applies to this plugin.
+  ##   ex: http_proxy_url = "http://proxy.example.com:3128"
+  #http_proxy_url = ""
+
   # The minimum period for Cloudwatch metrics is 1 minute (60s). However not all
   # metrics are made available to the 1 minute period. Some are collected at
   # 3 minute and 5 minutes intervals. See https://aws.amazon.com/cloudwatch/faqs/#monitoring.
@@ -90,35 +510,397 @@ func (c *CloudWatch) SampleConfig() string {
   ## Requested CloudWatch aggregation Period (required - must be a multiple of 60s)
   period = "5m"
 
+  ## Allow periods of 1s, 5s, 10s and 30s to pull high-resolution custom metrics
+  ## at their native resolution (optional)
+  #high_resolution = false
+
   ## Collection Delay (required - must account for metrics availability via CloudWatch API)
   delay = "5m"
 
+  ## Align the requested timeframe to period boundaries (optional), so that
+  ## every gather within the same period requests the same complete period.
+  #align_periods = false
+
+  ## Timeframe to backfill on the first gather (optional), e.g. "6h", instead
+  ## of only the last period. It is requested in chunks of at most 1440
+  ## periods per GetMetricStatistics request.
+  #backfill = "0s"
+
   ## Recomended: use metric 'interval' that is a multiple of 'period' to avoid
   ## gaps or overlap in pulled data
   interval = "5m"
 
   ## Configure the TTL for the internal cache of metrics.
-  ## Defaults to 1 hr if not specified
+  ## Defaults to 1 hr if not specified. Expired metrics are still gathered
+  ## when listing them again fails, e.g. due to throttling.
   #cache_ttl = "10m"
 
+  ## File persisting the internal cache of metrics across restarts (optional),
+  ## so that metrics listed less than 'cache_ttl' ago are not listed again.
+  #metric_cache_file = "/var/lib/telegraf/cloudwatch_metrics.json"
+
+  ## Only list the metrics having datapoints within the last 3 hours
+  ## (optional), skipping the ones of deleted resources. Metrics configured
+  ## without wildcards are not listed so always gathered.
+  #recently_active = false
+
+  ## Only select the listed metrics having exactly the dimensions of their
+  ## filter, including the filter dimensions without a value which otherwise
+  ## select metrics whatever their other dimensions (optional).
+  #strict_dimensions = false
+
   ## Metric Statistic Namespace (required)
   namespace = "AWS/ELB"
 
-  ## Maximum requests per second. Note that the global default AWS rate limit is
-  ## 10 reqs/sec, so if you define multiple namespaces, these should add up to a
-  ## maximum of 10. Optional - default value is 10.
+  ## Additional Metric Statistic Namespaces to gather (optional)
+  ## Metric filters defined below apply to every namespace.
+  #namespaces = ["AWS/EC2", "AWS/RDS"]
+
+  ## Measurement name of every metric, instead of "cloudwatch_{namespace}" (optional)
+  #measurement = "aws_metrics"
+
+  ## Prefix of the measurement names, replaces "cloudwatch_" in
+  ## "cloudwatch_{namespace}" (optional)
+  #measurement_prefix = "aws_"
+
+  ## Field naming scheme (optional)
+  ## "metric_statistic" names fields "{metric}_{statistic}", e.g. latency_average.
+  ## "statistic_only" names fields "{statistic}", e.g. average, and adds the
+  ## metric name as the 'metric_name' tag. Defaults to "metric_statistic".
+  #field_naming = "metric_statistic"
+
+  ## Label of a statistic in field names, and in the 'statistic' tag, instead
+  ## of its snake cased name (optional), e.g. latency_avg
+  #[inputs.cloudwatch.statistic_labels]
+  #  Average = "avg"
+  #  SampleCount = "n"
+
+  ## Also emit the Sum statistic divided by the period in seconds as the
+  ## '{metric}_rate' field (optional), e.g. the bytes per second of
+  ## NetworkBytesIn. Only applies to metrics gathering the Sum statistic.
+  #emit_rate = false
+
+  ## Tag every metric with the 'period' it is aggregated over, in seconds
+  ## (optional), e.g. to tell 1m and 5m aggregations apart.
+  #period_tag = false
+
+  ## Do not set the 'unit' tag of metrics whose unit is "None" (optional), as
+  ## commonly reported by custom metrics.
+  #omit_unit_none = false
+
+  ## Value of the 'unit' tag of the metrics of a CloudWatch unit instead of the
+  ## snake cased unit (optional), e.g. of "Bytes/Second" otherwise tagged
+  ## "bytes/_second"
+  #[inputs.cloudwatch.unit_labels]
+  #  "Bytes/Second" = "bytes_per_second"
+  #  "Count/Second" = "count_per_second"
+
+  ## Record SampleCount, and Sum in the Count unit, as integer fields instead
+  ## of floats (optional). The unit being unknown with 'use_get_metric_data',
+  ## only SampleCount is then converted.
+  #count_as_int = false
+
+  ## Record a point per statistic, with the 'statistic' tag and a single
+  ## 'value' field, instead of a field per statistic (optional). The metric is
+  ## then identified by the 'metric_name' tag. Only applies when
+  ## 'use_get_metric_data' is disabled.
+  #statistic_as_tag = false
+
+  ## Record the original timestamp of every datapoint, in unix milliseconds,
+  ## as the 'cloudwatch_timestamp' field (optional), keeping it available
+  ## once points are down-sampled or re-bucketed.
+  #include_timestamp_field = false
+
+  ## Tag every metric with the 'account_id' of the AWS account the credentials
+  ## belong to (optional), resolved once through STS GetCallerIdentity.
+  ## Requires the sts:GetCallerIdentity permission, granted to any identity.
+  #account_id_tag = false
+
+  ## Do not tag metrics with their 'region' (optional), e.g. in single
+  ## region setups to save a tag.
+  #omit_region_tag = false
+
+  ## Maximum requests per second, must be positive. Note that the default AWS
+  ## limits are 400 reqs/sec for GetMetricStatistics, 50 reqs/sec for
+  ## GetMetricData and 25 reqs/sec for ListMetrics per account and region, so
+  ## if you define multiple cloudwatch inputs, these should add up to less than
+  ## your account limits. Optional - default value is 10.
   ratelimit = 10
 
+  ## Timeout of each API request, in-flight requests are cancelled once it
+  ## expires so that a slow endpoint does not stall the gather. Should be lower
+  ## than the plugin 'interval'. Requests in flight are also cancelled when
+  ## telegraf shuts down. Optional - defaults to 30s.
+  #timeout = "30s"
+
+  ## Maximum number of in-flight GetMetricStatistics requests, bounding the
+  ## goroutines waiting on slow responses independently of 'ratelimit'.
+  ## Optional - defaults to 0, unbounded.
+  #max_concurrent_requests = 0
+
+  ## Delay the start of each gather by a random duration up to this value
+  ## (optional), spreading the API requests of agents sharing an account and
+  ## interval. Should be lower than 'delay'. Defaults to 0s.
+  #gather_jitter = "0s"
+
+  ## Print the metrics selected by the configuration to stdout instead of
+  ## gathering them (optional), one per line with their region and dimensions.
+  ## Useful with 'telegraf --test' to check the metric filters.
+  #dry_run = false
+
+  ## Use the GetMetricData API to gather metrics in batches of up to 500
+  ## queries per request instead of one GetMetricStatistics request per metric.
+  ## Note that GetMetricData results do not include the metric unit, so the
+  ## 'unit' tag is not set in this mode.
+  #use_get_metric_data = false
+
+  ## Also gather the metrics of the source accounts linked to this monitoring
+  ## account through CloudWatch cross-account observability (optional),
+  ## tagging them with their 'account_id'. Requires 'use_get_metric_data'.
+  #include_linked_accounts = false
+
+  ## Label of every metric, recorded as the 'metric_label' tag (optional).
+  ## With 'use_get_metric_data', CloudWatch resolves the placeholders of the
+  ## label of the queries, e.g. "${PROP('Dim.InstanceId')}". Otherwise the
+  ## ${PROP('Dim.<name>')}, ${PROP('MetricName')}, ${PROP('Namespace')},
+  ## ${PROP('Period')} and ${PROP('Region')} placeholders are resolved by the
+  ## plugin, so that both modes record the same tag.
+  #label_template = "${PROP('MetricName')} ${PROP('Dim.InstanceId')}"
+
+  ## Add the tags of the EC2 instance to metrics having an InstanceId dimension,
+  ## whatever their namespace, along with its 'availability_zone' tag.
+  #enrich_ec2_tags = false
+
+  ## How often EC2 instance, RDS instance and resource tags are refreshed, and
+  ## how long the tags of a resource are kept after it was last seen, e.g. once
+  ## terminated.
+  ## Defaults to 5m and 24h.
+  #ec2_tag_refresh_interval = "5m"
+  #ec2_tag_cache_ttl = "24h"
+
+  ## EC2 instance tag keys to add when 'enrich_ec2_tags' is enabled. Only the
+  ## listed tags are added, so only the availability zone is added when the
+  ## list is empty.
+  #ec2_tag_keys = ["Name"]
+
+  ## Dimension whose value is the id of the EC2 instance of a metric, e.g. in
+  ## custom namespaces naming it otherwise (optional). Defaults to InstanceId.
+  #ec2_tag_dimension = "InstanceId"
+
+  ## Filters limiting the EC2 instances whose tags are fetched (optional)
+  ## Each filter is a DescribeInstances filter name, such as "vpc-id" or
+  ## "tag:env", along with the values to match. Defaults to every instance of
+  ## the region. 'ec2_tagged_instances_only' also limits them to the instances
+  ## having one of the 'ec2_tag_keys', which large fleets may enable to fetch
+  ## and cache fewer instances, the other ones then not having the
+  ## availability zone tag either.
+  #ec2_tagged_instances_only = false
+  #[[inputs.cloudwatch.ec2_instance_filters]]
+  #  name = "tag:env"
+  #  values = ["prod"]
+
+  ## Add the tags of the RDS instance to AWS/RDS metrics having a
+  ## DBInstanceIdentifier dimension.
+  #enrich_rds_tags = false
+
+  ## RDS instance tag keys to add when 'enrich_rds_tags' is enabled. Only the
+  ## listed tags are added, so no tag is added when the list is empty.
+  #rds_tag_keys = ["Name"]
+
+  ## Add the tags fetched through the Resource Groups Tagging API to metrics
+  ## having a dimension identifying a tagged resource, such as InstanceId,
+  ## LoadBalancer, DBInstanceIdentifier, QueueName, TableName or FunctionName.
+  #enrich_resource_tags = false
+
+  ## Resource tag keys to add when 'enrich_resource_tags' is enabled. Only the
+  ## listed tags are added, so no tag is added when the list is empty.
+  #resource_tag_keys = ["Name"]
+
+  ## Resource types whose tags are fetched, as "service[:type]" (optional)
+  ## Defaults to every resource of the region.
+  #resource_type_filters = ["elasticloadbalancing:loadbalancer", "rds:db"]
+
+  ## Only pull the metrics of the resources having every tag of these filters,
+  ## along with one of its values when set (optional), e.g. every resource
+  ## tagged env=prod. The matching resources of the 'resource_type_filters'
+  ## are fetched through the tagging API, refreshed every
+  ## 'ec2_tag_refresh_interval', and selected by the dimension identifying
+  ## them in metrics, or by the 'arn' of metric filters. Requires the
+  ## tag:GetResources permission.
+  #[[inputs.cloudwatch.resource_tag_filters]]
+  #  key = "env"
+  #  values = ["prod"]
+
+  ## Do not add the EC2, RDS and resource tags whose value is empty (optional),
+  ## which many outputs reject.
+  #skip_empty_tags = false
+
+  ## Statistics to pull for every metric (optional)
+  ## Defaults to Average, Maximum, Minimum, Sum and SampleCount. Each statistic
+  ## is billed as a separate request, so only pull the ones you need.
+  #statistics = ["Average", "Sum"]
+
+  ## Percentile statistics to pull for every metric (optional)
+  ## When extended statistics are configured, the default statistics above are
+  ## no longer pulled unless 'statistics' is set explicitly.
+  #extended_statistics = ["p95", "p99"]
+
+  ## Fill the periods of the requested timeframe without datapoints (optional)
+  ## "none" leaves gaps, "previous" repeats the previous datapoint of the
+  ## metric and "zero" sets every statistic to 0. Only applies when
+  ## 'use_get_metric_data' is disabled. Defaults to "none".
+  #fill = "none"
+
+  ## Record the Sum and SampleCount statistics of the periods without
+  ## datapoints, or without these statistics, as 0 rather than omitting them
+  ## (optional). Counters then have no gaps, other statistics being filled
+  ## according to 'fill'. Only applies when 'use_get_metric_data' is disabled.
+  #zero_counts = false
+
+  ## Only emit the datapoints newer than the last one gathered for each metric
+  ## (optional), as a datapoint is gathered again while the 'interval' is
+  ## shorter than the 'period'. Only applies when 'use_get_metric_data' is
+  ## disabled.
+  #only_new_datapoints = false
+
+  ## Statistics to pull for the metrics of a namespace, overrides 'statistics'
+  ## (optional)
+  #[inputs.cloudwatch.namespace_statistics]
+  #  "AWS/Billing" = ["Sum"]
+  #  "AWS/EC2" = ["Average"]
+
+  ## Collection delay of the metrics of a namespace, overrides 'delay'
+  ## (optional), e.g. for services publishing their metrics late
+  #[inputs.cloudwatch.namespace_delays]
+  #  "AWS/Billing" = "6h"
+  #  "AWS/S3" = "24h"
+
+  ## Rename the tags of dimensions (optional)
+  ## The value of the 'from' dimension, given as named by CloudWatch or snake
+  ## cased, is set as the 'to' tag.
+  #[[inputs.cloudwatch.tag_rename]]
+  #  from = "LoadBalancerName"
+  #  to = "lb"
+
+  ## Derive tags from the value of another tag (optional)
+  ## Each capture group of 'pattern' matched against the 'source' tag value is
+  ## set as the tag of the same position in 'tags'. For example, the following
+  ## sets a 'pool' tag to 'web' for an EC2 'Name' tag of 'web_1', which must
+  ## then be listed in 'ec2_tag_keys' as no tag is special cased.
+  #[[inputs.cloudwatch.tag_derivations]]
+  #  source = "Name"
+  #  pattern = '^(.+)_[^_]*$'
+  #  tags = ["pool"]
+  ##
+  ## Alternatively, the parts of the 'source' tag value split by 'delimiter'
+  ## are set as 'tags' when there are as many of them, e.g. the following sets
+  ## the 'team', 'service' and 'az' tags for a 'Name' tag of 'ops-web-1a'.
+  #[[inputs.cloudwatch.tag_derivations]]
+  #  source = "Name"
+  #  delimiter = "-"
+  #  tags = ["team", "service", "az"]
+
+  ## Metric math expressions evaluated by CloudWatch (optional)
+  ## Requires 'use_get_metric_data'. The results are recorded in the
+  ## 'cloudwatch_metric_math' measurement as the field named after 'label', or
+  ## 'id' when no label is set. Expressions may refer to the ids of each other,
+  ## and 'period' defaults to the plugin period.
+  #[[inputs.cloudwatch.metric_math]]
+  #  id = "errors"
+  #  expression = "SUM(SEARCH('{AWS/ELB,LoadBalancerName} MetricName=HTTPCode_Backend_4XX', 'Sum', 300))"
+  #[[inputs.cloudwatch.metric_math]]
+  #  id = "requests"
+  #  expression = "SUM(SEARCH('{AWS/ELB,LoadBalancerName} MetricName=RequestCount', 'Sum', 300))"
+  #[[inputs.cloudwatch.metric_math]]
+  #  id = "error_rate"
+  #  expression = "100 * errors / requests"
+  #  label = "error_rate_percent"
+  #  period = "5m"
+
+  ## Exclude the selected metrics whose name matches one of these glob
+  ## patterns (optional)
+  #exclude_names = ["HTTPCode_ELB_*"]
+
+  ## Exclude the selected metrics having one of these dimensions (optional)
+  ## The value may be a glob pattern, omitting it excludes every metric having
+  ## the dimension.
+  #[[inputs.cloudwatch.exclude_dimensions]]
+  #  name = "LoadBalancerName"
+  #  value = "test-*"
+
+  ## Only gather one of 'shard_total' shards of the selected metrics, the
+  ## metrics being split by a hash of their namespace, name and dimensions
+  ## (optional). Agents configured alike with each 'shard_index' from 0 to
+  ## 'shard_total' - 1 gather every metric once. Defaults to no sharding.
+  #shard_index = 0
+  #shard_total = 0
+
   ## Metrics to Pull (optional)
   ## Defaults to all Metrics in Namespace if nothing is provided
   ## Refreshes Namespace available metrics every 1h
   #[[inputs.cloudwatch.metrics]]
+  #  ## Metric names, "*" selects every available metric matching the
+  #  ## dimensions below
   #  names = ["Latency", "RequestCount"]
   #
+  #  ## Regular expressions matched against the names of the available metrics,
+  #  ## in addition to 'names' (optional)
+  #  names_regex = ["^HTTPCode_.*"]
+  #
+  #  ## ARN of the resource of these metrics (optional)
+  #  ## Adds the dimension identifying the resource, e.g. the TargetGroup of an
+  #  ## ALB target group, and only pulls the metrics of its region. The tags of
+  #  ## the resource are added when 'enrich_resource_tags' is enabled.
+  #  arn = "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/web/73e2d6bc24d8a067"
+  #
+  #  ## Statistics to pull for these metrics, overrides 'statistics' (optional)
+  #  statistics = ["Average"]
+  #  extended_statistics = ["p99"]
+  #
+  #  ## Period and delay for these metrics, override 'period' and 'delay' (optional)
+  #  period = "1m"
+  #  delay = "1m"
+  #
+  #  ## Only pull the datapoints of these metrics in the given unit (optional)
+  #  ## Must be a CloudWatch unit such as "Bytes", "Bits" or "Count/Second".
+  #  unit = "Bytes"
+  #
+  #  ## Tag the datapoints of these metrics with the 'label' tag (optional),
+  #  ## telling apart the filters of the same namespace.
+  #  label = "public-lbs"
+  #
+  #  ## Record these metrics in this measurement, overriding 'measurement' and
+  #  ## the measurement of their namespace (optional)
+  #  measurement = "latency"
+  #
+  #  ## Only pull the metrics of this linked source account (optional)
+  #  ## Requires 'use_get_metric_data' and 'include_linked_accounts'.
+  #  account_id = "123456789012"
+  #
+  #  ## Also pull the anomaly detection band of every statistic of these
+  #  ## metrics, this many standard deviations wide, as the
+  #  ## '{field}_band_upper' and '{field}_band_lower' fields (optional)
+  #  ## Requires 'use_get_metric_data' and an anomaly detector of the
+  #  ## statistic, bands being empty otherwise.
+  #  anomaly_band = 2.0
+  #
   #  ## Dimension filters for Metric (optional)
+  #  ## The value may be a glob pattern such as "p-*", or "*" to match any value.
+  #  ## Omitting the value selects every metric having the dimension, whatever
+  #  ## its other dimensions, unless 'strict_dimensions' is enabled.
   #  [[inputs.cloudwatch.metrics.dimensions]]
   #    name = "LoadBalancerName"
   #    value = "p-example"
+  #
+  #  ## Dimension combinations of these metrics (optional)
+  #  ## Each set selects the metrics having its dimensions along with the ones
+  #  ## above, e.g. both the per load balancer and the per availability zone
+  #  ## metrics of the load balancer.
+  #  [[inputs.cloudwatch.metrics.dimension_sets]]
+  #  [[inputs.cloudwatch.metrics.dimension_sets]]
+  #    [[inputs.cloudwatch.metrics.dimension_sets.dimensions]]
+  #      name = "AvailabilityZone"
+  #      value = "*"
 `
 }
 
@@ -126,14 +908,40 @@ func (c *CloudWatch) Description() string {
 	return "Pull Metric Statistics from Amazon CloudWatch"
 }
 
-func SelectMetrics(c *CloudWatch) ([]*cloudwatch.Metric, error) {
-	var metrics []*cloudwatch.Metric
+func SelectMetrics(c *CloudWatch) ([]*SelectedMetric, error) {
+	// merge the single namespace option, kept for backward compatibility,
+	// into the list of namespaces
+	if c.Namespace != "" && !contains(c.Namespaces, c.Namespace) {
+		c.Namespaces = append([]string{c.Namespace}, c.Namespaces...)
+	}
+
+	var metrics []*SelectedMetric
 
 	// check for provided metric filter
 	if c.Metrics != nil {
-		metrics = []*cloudwatch.Metric{}
+		metrics = []*SelectedMetric{}
 		for _, m := range c.Metrics {
-			if !hasWilcard(m.Dimensions) {
+			if contains(m.MetricNames, metricNameWildcard) {
+				// every available metric name matching the dimensions
+				allMetrics, err := c.fetchNamespaceMetrics(m.Dimensions)
+				if err != nil {
+					return nil, err
+				}
+				for _, metric := range allMetrics {
+					if isSelected(*metric.MetricName, metric.Metric, m.Dimensions, c.StrictDims) && m.selectsAccount(metric) {
+						metrics = append(metrics, &SelectedMetric{
+							Metric: &cloudwatch.Metric{
+								Namespace:  metric.Namespace,
+								MetricName: metric.MetricName,
+								Dimensions: metric.Dimensions,
+							},
+							Region:    metric.Region,
+							AccountID: metric.AccountID,
+							Filter:    m,
+						})
+					}
+				}
+			} else if !hasWilcard(m.Dimensions) {
 				dimensions := make([]*cloudwatch.Dimension, len(m.Dimensions))
 				for k, d := range m.Dimensions {
 					dimensions[k] = &cloudwatch.Dimension{
@@ -141,204 +949,1791 @@ func SelectMetrics(c *CloudWatch) ([]*cloudwatch.Metric, error) {
 						Value: aws.String(d.Value),
 					}
 				}
-				for _, name := range m.MetricNames {
-					metrics = append(metrics, &cloudwatch.Metric{
-						Namespace:  aws.String(c.Namespace),
-						MetricName: aws.String(name),
-						Dimensions: dimensions,
-					})
+				for _, region := range c.regions() {
+					if m.arnRegion != "" && m.arnRegion != region {
+						continue
+					}
+					for _, namespace := range c.Namespaces {
+						for _, name := range m.MetricNames {
+							metrics = append(metrics, &SelectedMetric{
+								Metric: &cloudwatch.Metric{
+									Namespace:  aws.String(namespace),
+									MetricName: aws.String(name),
+									Dimensions: dimensions,
+								},
+								Region:    region,
+								AccountID: m.AccountID,
+								Filter:    m,
+							})
+						}
+					}
 				}
 			} else {
-				allMetrics, err := c.fetchNamespaceMetrics()
+				allMetrics, err := c.fetchNamespaceMetrics(m.Dimensions)
 				if err != nil {
 					return nil, err
 				}
 				for _, name := range m.MetricNames {
 					for _, metric := range allMetrics {
-						if isSelected(name, metric, m.Dimensions) {
-							metrics = append(metrics, &cloudwatch.Metric{
-								Namespace:  aws.String(c.Namespace),
-								MetricName: aws.String(name),
-								Dimensions: metric.Dimensions,
+						if isSelected(name, metric.Metric, m.Dimensions, c.StrictDims) && m.selectsAccount(metric) {
+							metrics = append(metrics, &SelectedMetric{
+								Metric: &cloudwatch.Metric{
+									Namespace:  metric.Namespace,
+									MetricName: aws.String(name),
+									Dimensions: metric.Dimensions,
+								},
+								Region:    metric.Region,
+								AccountID: metric.AccountID,
+								Filter:    m,
 							})
 						}
 					}
 				}
 			}
+
+			if len(m.namesRegex) > 0 {
+				allMetrics, err := c.fetchNamespaceMetrics(m.Dimensions)
+				if err != nil {
+					return nil, err
+				}
+				for _, metric := range allMetrics {
+					if m.matchesNamesRegex(*metric.MetricName) && isSelected(*metric.MetricName, metric.Metric, m.Dimensions, c.StrictDims) && m.selectsAccount(metric) {
+						metrics = append(metrics, &SelectedMetric{
+							Metric: &cloudwatch.Metric{
+								Namespace:  metric.Namespace,
+								MetricName: metric.MetricName,
+								Dimensions: metric.Dimensions,
+							},
+							Region:    metric.Region,
+							AccountID: metric.AccountID,
+							Filter:    m,
+						})
+					}
+				}
+			}
 		}
 	} else {
-		var err error
-		metrics, err = c.fetchNamespaceMetrics()
+		allMetrics, err := c.fetchNamespaceMetrics(nil)
 		if err != nil {
 			return nil, err
 		}
+		metrics = allMetrics
 	}
-	return metrics, nil
+	metrics, err := c.selectTaggedMetrics(metrics)
+	if err != nil {
+		return nil, err
+	}
+	return c.shardMetrics(dedupeMetrics(c.excludeMetrics(metrics))), nil
 }
 
-func (c *CloudWatch) Gather(acc telegraf.Accumulator) error {
-	if c.client == nil {
-		c.initializeCloudWatch()
+/*
+ * Keep the Metrics of the shard of this agent, if sharding is enabled
+ */
+func (c *CloudWatch) shardMetrics(metrics []*SelectedMetric) []*SelectedMetric {
+	if c.ShardTotal <= 1 {
+		return metrics
 	}
-
-	metrics, err := SelectMetrics(c)
-	if err != nil {
-		return err
+	kept := make([]*SelectedMetric, 0, len(metrics)/c.ShardTotal+1)
+	for _, metric := range metrics {
+		if metricShard(metric, c.ShardTotal) == c.ShardIndex {
+			kept = append(kept, metric)
+		}
 	}
-	metricCount := len(metrics)
-	errChan := errchan.New(metricCount)
+	return kept
+}
 
-	now := time.Now()
+/*
+ * Resolve the shard of given Metric among total shards, the same whatever the
+ * order of its dimensions
+ */
+func metricShard(metric *SelectedMetric, total int) int {
+	h := fnv.New32a()
+	h.Write([]byte(metricKey(metric.Metric)))
+	return int(h.Sum32() % uint32(total))
+}
 
-	// limit concurrency or we can easily exhaust user connection limit
-	// see cloudwatch API request limits:
-	// http://docs.aws.amazon.com/AmazonCloudWatch/latest/DeveloperGuide/cloudwatch_limits.html
-	lmtr := limiter.NewRateLimiter(c.RateLimit, time.Second)
-	defer lmtr.Stop()
-	var wg sync.WaitGroup
-	wg.Add(len(metrics))
-	for _, m := range metrics {
-		<-lmtr.C
-		go func(inm *cloudwatch.Metric) {
-			defer wg.Done()
-			c.gatherMetric(acc, inm, now, errChan.C)
-		}(m)
+/*
+ * Remove the Metrics matching the exclusion filters
+ */
+func (c *CloudWatch) excludeMetrics(metrics []*SelectedMetric) []*SelectedMetric {
+	if c.excludeNames == nil && len(c.ExcludeDimensions) == 0 {
+		return metrics
 	}
-	wg.Wait()
-
-	return errChan.Error()
+	kept := make([]*SelectedMetric, 0, len(metrics))
+	for _, metric := range metrics {
+		if !c.isExcluded(metric) {
+			kept = append(kept, metric)
+		}
+	}
+	return kept
 }
 
-func init() {
-	inputs.Add("cloudwatch", func() telegraf.Input {
-		ttl, _ := time.ParseDuration("1hr")
-		return &CloudWatch{
-			CacheTTL:  internal.Duration{Duration: ttl},
-			RateLimit: 10,
+func (c *CloudWatch) isExcluded(metric *SelectedMetric) bool {
+	if c.excludeNames != nil && c.excludeNames.Match(aws.StringValue(metric.MetricName)) {
+		return true
+	}
+	for _, d := range c.ExcludeDimensions {
+		for _, d2 := range metric.Dimensions {
+			if d.Name == aws.StringValue(d2.Name) && d.matches(aws.StringValue(d2.Value)) {
+				return true
+			}
 		}
-	})
+	}
+	return false
 }
 
 /*
- * Initialize CloudWatch client
+ * Remove the Metrics selected more than once by overlapping filters, keeping
+ * the first one selected along with its filter
  */
-func (c *CloudWatch) initializeCloudWatch() error {
-	credentialConfig := &internalaws.CredentialConfig{
-		Region:    c.Region,
-		AccessKey: c.AccessKey,
-		SecretKey: c.SecretKey,
-		RoleARN:   c.RoleARN,
-		Profile:   c.Profile,
-		Filename:  c.Filename,
-		Token:     c.Token,
+func dedupeMetrics(metrics []*SelectedMetric) []*SelectedMetric {
+	seen := map[string]bool{}
+	deduped := make([]*SelectedMetric, 0, len(metrics))
+	for _, metric := range metrics {
+		key := metric.key()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		deduped = append(deduped, metric)
 	}
-	configProvider := credentialConfig.Credentials()
+	return deduped
+}
 
-	c.client = cloudwatch.New(configProvider)
+// Start creates the context of the plugin requests, the metrics still being
+// gathered every interval by Gather.
+func (c *CloudWatch) Start(acc telegraf.Accumulator) error {
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 	return nil
 }
 
-/*
- * Fetch available metrics for given CloudWatch Namespace
- */
-func (c *CloudWatch) fetchNamespaceMetrics() ([]*cloudwatch.Metric, error) {
-	if c.metricCache != nil && c.metricCache.IsValid() {
-		return c.metricCache.Metrics, nil
+// Stop cancels the requests in flight on shutdown, and stops the gather in
+// progress from issuing new ones.
+func (c *CloudWatch) Stop() {
+	if c.cancel != nil {
+		c.cancel()
 	}
+}
 
-	metrics := []*cloudwatch.Metric{}
+// ListMetrics writes the metrics selected by the configuration to w, one per
+// line, without requesting their statistics.
+func (c *CloudWatch) ListMetrics(w io.Writer) error {
+	metrics, err := SelectMetrics(c)
+	if err != nil {
+		return err
+	}
+	return writeMetrics(w, metrics)
+}
 
-	var token *string
-	for more := true; more; {
-		params := &cloudwatch.ListMetricsInput{
-			Namespace:  aws.String(c.Namespace),
-			Dimensions: []*cloudwatch.DimensionFilter{},
-			NextToken:  token,
-			MetricName: nil,
+/*
+ * Write the region, namespace, name and dimensions of each Metric on a line
+ */
+func writeMetrics(w io.Writer, metrics []*SelectedMetric) error {
+	for _, metric := range metrics {
+		dimensions := make([]string, len(metric.Dimensions))
+		for i, d := range metric.Dimensions {
+			dimensions[i] = aws.StringValue(d.Name) + "=" + aws.StringValue(d.Value)
 		}
-
-		resp, err := c.client.ListMetrics(params)
+		_, err := fmt.Fprintf(w, "%s %s %s %s\n", metric.Region, aws.StringValue(metric.Namespace),
+			aws.StringValue(metric.MetricName), strings.Join(dimensions, ","))
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
+	return nil
+}
 
-		metrics = append(metrics, resp.Metrics...)
+func (c *CloudWatch) Gather(acc telegraf.Accumulator) error {
+	// a gather slower than the interval, e.g. throttled, is not overlapped by
+	// the next one
+	c.mu.Lock()
+	if c.gathering {
+		c.mu.Unlock()
+		log.Printf("W! CloudWatch gather skipped, the previous gather of regions %s is still running", strings.Join(c.regions(), ", "))
+		return nil
+	}
+	c.gathering = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.gathering = false
+		c.mu.Unlock()
+	}()
 
-		token = resp.NextToken
-		more = token != nil
+	if !c.initialized {
+		if err := c.Init(); err != nil {
+			return err
+		}
+	} else if err := c.checkPeriods(); err != nil {
+		// a period changed since, e.g. by an embedding program, would fail
+		// every request of the gather with a less helpful error
+		return err
 	}
 
-	c.metricCache = &MetricCache{
-		Metrics: metrics,
-		Fetched: time.Now(),
-		TTL:     c.CacheTTL.Duration,
+	// nothing is gathered once the plugin is stopped during the jitter
+	if c.sleepJitter() {
+		return nil
 	}
 
+	if c.clients == nil {
+		c.initializeCloudWatch()
+	} else {
+		c.initializeMissingClients()
+	}
+	if c.stats == nil {
+		c.registerStats()
+	}
+	defer c.renewExpiredCredentials()
+	c.resetStats()
+
+	if c.AccountIDTag && c.accountID == "" {
+		if err := c.fetchAccountID(); err != nil {
+			log.Printf("E! Error resolving AWS account id, metrics are not tagged with it: %s", err)
+		}
+	}
+
+	metrics, err := SelectMetrics(c)
+	if err != nil {
+		return err
+	}
+	if c.DryRun {
+		return writeMetrics(os.Stdout, metrics)
+	}
+
+	if c.EnrichEc2Tags {
+		for _, region := range c.regions() {
+			if err := c.fetchEc2Tags(region); err != nil {
+				log.Printf("E! Error fetching EC2 instance tags of region %s, using cached tags: %s", region, err)
+			}
+		}
+	}
+	if c.EnrichRdsTags {
+		for _, region := range c.regions() {
+			if err := c.fetchRdsTags(region); err != nil {
+				log.Printf("E! Error fetching RDS instance tags of region %s, using cached tags: %s", region, err)
+			}
+		}
+	}
+	if c.EnrichResourceTags {
+		for _, region := range c.regions() {
+			if err := c.fetchResourceTags(region); err != nil {
+				log.Printf("E! Error fetching resource tags of region %s, using cached tags: %s", region, err)
+			}
+		}
+	}
+
+	now := time.Now()
+
+	c.emptyMetrics = map[string]int{}
+	defer c.reportEmptyMetrics(len(metrics))
+
+	// following gathers only request the last period
+	defer func() { c.backfilled = true }()
+
+	if c.UseGetMetricData {
+		return c.gatherMetricData(acc, metrics, now)
+	}
+
+	metricCount := len(metrics)
+	errChan := errchan.New(metricCount)
+
+	// limit concurrency or we can easily exhaust user connection limit
+	// see cloudwatch API request limits:
+	// http://docs.aws.amazon.com/AmazonCloudWatch/latest/DeveloperGuide/cloudwatch_limits.html
+	lmtr := limiter.NewRateLimiter(c.RateLimit, time.Second)
+	defer lmtr.Stop()
+
+	// and bound the requests in flight, if configured
+	var sem chan struct{}
+	if c.MaxConcurrent > 0 {
+		sem = make(chan struct{}, c.MaxConcurrent)
+	}
+
+	// stop issuing requests once the plugin is stopped
+	ctx := c.context()
+	var wg sync.WaitGroup
+dispatch:
+	for i, m := range metrics {
+		select {
+		case <-lmtr.C:
+		case <-ctx.Done():
+			errChan.C <- &metricsError{metrics: metrics[i:], err: ctx.Err()}
+			break dispatch
+		}
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errChan.C <- &metricsError{metrics: metrics[i:], err: ctx.Err()}
+				break dispatch
+			}
+		}
+		wg.Add(1)
+		go func(inm *SelectedMetric) {
+			defer wg.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			c.gatherMetric(acc, inm, now, errChan.C)
+		}(m)
+	}
+	wg.Wait()
+
+	return gatherError(errChan, metricCount)
+}
+
+/*
+ * Summarize the errors of a gather of given number of metrics, as the number
+ * of metrics that failed along with the distinct errors, logging the failed
+ * metrics at debug level. The datapoints of the other metrics are gathered.
+ * The errors of no metric, e.g. of metric math, are not counted.
+ */
+func gatherError(errChan *errchan.ErrChan, total int) error {
+	close(errChan.C)
+
+	failed := map[*SelectedMetric]bool{}
+	names := []string{}
+	messages := []string{}
+	seen := map[string]bool{}
+	// the errors of no metric, e.g. of metric math, are reported on their own
+	others := []string{}
+	for err := range errChan.C {
+		if err == nil {
+			continue
+		}
+		merr, ok := err.(*metricsError)
+		if !ok {
+			others = append(others, err.Error())
+			continue
+		}
+		for _, metric := range merr.metrics {
+			if !failed[metric] {
+				failed[metric] = true
+				names = append(names, metricName(metric))
+			}
+		}
+		if !seen[merr.err.Error()] {
+			seen[merr.err.Error()] = true
+			messages = append(messages, "["+merr.err.Error()+"]")
+		}
+	}
+	if len(messages) == 0 && len(others) == 0 {
+		return nil
+	}
+
+	if len(names) > 0 {
+		log.Printf("D! CloudWatch metrics failed to be gathered: %s", strings.Join(names, ", "))
+	}
+	summary := others
+	if len(messages) > 0 {
+		summary = append([]string{fmt.Sprintf("%d of %d metrics failed to be gathered: %s", len(failed), total, strings.Join(messages, ", "))}, others...)
+	}
+	return errors.New(strings.Join(summary, "; "))
+}
+
+func (e *metricsError) Error() string {
+	return e.err.Error()
+}
+
+/*
+ * Describe given Metric in logs, by region, namespace, name and dimensions
+ */
+func metricName(metric *SelectedMetric) string {
+	dimensions := make([]string, len(metric.Dimensions))
+	for i, d := range metric.Dimensions {
+		dimensions[i] = aws.StringValue(d.Name) + "=" + aws.StringValue(d.Value)
+	}
+	return fmt.Sprintf("%s/%s/%s{%s}", metric.Region, aws.StringValue(metric.Namespace),
+		aws.StringValue(metric.MetricName), strings.Join(dimensions, ","))
+}
+
+// Init validates the configuration, it is called by the first Gather.
+func (c *CloudWatch) Init() error {
+	if c.Namespace == "" && len(c.Namespaces) == 0 {
+		return fmt.Errorf("namespace is required")
+	}
+
+	if err := c.checkPeriods(); err != nil {
+		return err
+	}
+	if c.Delay.Duration < 0 {
+		return fmt.Errorf("delay must not be negative, got %s", c.Delay.Duration)
+	}
+	if c.Backfill.Duration < 0 {
+		return fmt.Errorf("backfill must not be negative, got %s", c.Backfill.Duration)
+	}
+
+	if c.HTTPProxyURL != "" {
+		proxyURL, err := url.Parse(c.HTTPProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid http_proxy_url %q: %s", c.HTTPProxyURL, err)
+		}
+		c.proxyURL = proxyURL
+	}
+
+	if c.Timeout.Duration < 0 {
+		return fmt.Errorf("timeout must not be negative, got %s", c.Timeout.Duration)
+	}
+	if c.GatherJitter.Duration < 0 {
+		return fmt.Errorf("gather_jitter must not be negative, got %s", c.GatherJitter.Duration)
+	}
+
+	if c.RateLimit <= 0 {
+		return fmt.Errorf("ratelimit must be a positive number of requests per second, got %d", c.RateLimit)
+	}
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("max_concurrent_requests must not be negative, got %d", c.MaxConcurrent)
+	}
+
+	if err := checkStatistics(c.Statistics, c.ExtendedStatistics); err != nil {
+		return err
+	}
+	for namespace, statistics := range c.NamespaceStatistics {
+		if err := checkStatistics(statistics, nil); err != nil {
+			return fmt.Errorf("namespace %q: %v", namespace, err)
+		}
+	}
+	c.namespaceDelays = map[string]time.Duration{}
+	for namespace, delay := range c.NamespaceDelays {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return fmt.Errorf("namespace %q: invalid delay %q: %s", namespace, delay, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("namespace %q: delay must not be negative, got %s", namespace, d)
+		}
+		c.namespaceDelays[namespace] = d
+	}
+
+	switch c.Fill {
+	case "", fillNone, fillPrevious, fillZero:
+	default:
+		return fmt.Errorf("invalid fill %q, must be one of none, previous or zero", c.Fill)
+	}
+
+	switch c.FieldNaming {
+	case "", fieldNamingMetricStatistic, fieldNamingStatisticOnly:
+	default:
+		return fmt.Errorf("invalid field_naming %q, must be metric_statistic or statistic_only", c.FieldNaming)
+	}
+
+	for statistic, label := range c.StatisticLabels {
+		if !contains(defaultStatistics, statistic) && !isPercentile(statistic) && statistic != rateStatistic {
+			return fmt.Errorf("statistic_labels: invalid statistic %q, must be one of %s, a percentile or %s",
+				statistic, strings.Join(defaultStatistics, ", "), rateStatistic)
+		}
+		if label == "" {
+			return fmt.Errorf("statistic_labels: empty label of statistic %q", statistic)
+		}
+	}
+	if c.ShardTotal < 0 {
+		return fmt.Errorf("shard_total must not be negative, got %d", c.ShardTotal)
+	}
+	if c.ShardIndex < 0 || (c.ShardIndex > 0 && c.ShardIndex >= c.ShardTotal) {
+		return fmt.Errorf("shard_index must be between 0 and shard_total - 1, got %d of %d", c.ShardIndex, c.ShardTotal)
+	}
+	for unit, label := range c.UnitLabels {
+		if !contains(cloudwatch.StandardUnit_Values(), unit) {
+			return fmt.Errorf("unit_labels: invalid unit %q", unit)
+		}
+		if label == "" {
+			return fmt.Errorf("unit_labels: empty label of unit %q", unit)
+		}
+	}
+
+	if c.Ec2TaggedOnly && len(c.Ec2TagKeys) == 0 {
+		return fmt.Errorf("ec2_tagged_instances_only requires ec2_tag_keys")
+	}
+
+	for _, rename := range c.TagRenames {
+		if rename.From == "" || rename.To == "" {
+			return fmt.Errorf("tag_rename requires both from and to, got %q and %q", rename.From, rename.To)
+		}
+	}
+
+	if err := c.compileTagDerivations(); err != nil {
+		return err
+	}
+	for _, derivation := range c.TagDerivations {
+		if !c.isEnrichedTag(derivation.Source) {
+			log.Printf("W! Tag derivation source %q is not a tag key of enabled EC2, RDS or resource tags, "+
+				"it only applies to a dimension tag of that name", derivation.Source)
+		}
+	}
+
+	if err := c.checkMetricMath(); err != nil {
+		return err
+	}
+	if err := c.checkCredentialSets(); err != nil {
+		return err
+	}
+	if err := c.checkResourceTagFilters(); err != nil {
+		return err
+	}
+
+	// GetMetricStatistics does not query the metrics of other accounts
+	if c.LinkedAccounts && !c.UseGetMetricData {
+		return fmt.Errorf("include_linked_accounts requires use_get_metric_data")
+	}
+
+	excludeNames, err := filter.Compile(c.ExcludeNames)
+	if err != nil {
+		return fmt.Errorf("invalid exclude_names: %s", err)
+	}
+	c.excludeNames = excludeNames
+	for _, d := range c.ExcludeDimensions {
+		if err := d.compileValueFilter(); err != nil {
+			return err
+		}
+	}
+
+	c.Metrics = expandDimensionSets(c.Metrics)
+	for _, m := range c.Metrics {
+		if m.Delay.Duration < 0 {
+			return fmt.Errorf("metric delay must not be negative, got %s", m.Delay.Duration)
+		}
+		if err := checkStatistics(m.Statistics, m.ExtendedStatistics); err != nil {
+			return err
+		}
+		if m.Unit != "" && !contains(cloudwatch.StandardUnit_Values(), m.Unit) {
+			return fmt.Errorf("invalid metric unit %q", m.Unit)
+		}
+		if err := m.compileNamesRegex(); err != nil {
+			return err
+		}
+		if err := m.resolveARN(); err != nil {
+			return err
+		}
+		if m.AccountID != "" && !c.LinkedAccounts {
+			return fmt.Errorf("metric account_id %q requires include_linked_accounts", m.AccountID)
+		}
+		if m.AnomalyBand < 0 {
+			return fmt.Errorf("metric anomaly_band must not be negative, got %v", m.AnomalyBand)
+		}
+		if m.AnomalyBand > 0 && !c.UseGetMetricData {
+			return fmt.Errorf("metric anomaly_band requires use_get_metric_data")
+		}
+		for _, d := range m.Dimensions {
+			if err := d.compileValueFilter(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.MetricCacheFile != "" {
+		if err := c.loadMetricCache(); err != nil {
+			log.Printf("E! Unable to load the CloudWatch metric cache file %s: %s", c.MetricCacheFile, err)
+		}
+	}
+
+	c.initialized = true
+	return nil
+}
+
+/*
+ * Sleep for a random duration up to the gather jitter, interrupted once the
+ * plugin is stopped, telling whether it was
+ */
+func (c *CloudWatch) sleepJitter() bool {
+	ctx := c.context()
+	shutdown := make(chan struct{})
+	slept := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(shutdown)
+		case <-slept:
+		}
+	}()
+	internal.RandomSleep(c.GatherJitter.Duration, shutdown)
+	close(slept)
+	return ctx.Err() != nil
+}
+
+/*
+ * Check the period of the plugin and the ones of metric filters overriding it
+ */
+func (c *CloudWatch) checkPeriods() error {
+	if err := checkPeriod("period", c.Period.Duration, c.HighResolution); err != nil {
+		return err
+	}
+	for _, m := range c.Metrics {
+		if m.Period.Duration != 0 {
+			if err := checkPeriod("metric period", m.Period.Duration, c.HighResolution); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * Check that a period is accepted by CloudWatch
+ */
+func checkPeriod(name string, period time.Duration, highResolution bool) error {
+	if period > 0 && period%time.Minute == 0 {
+		return nil
+	}
+	if !highResolution {
+		return fmt.Errorf("%s must be a positive multiple of 60s, got %s", name, period)
+	}
+	for _, p := range highResolutionPeriods {
+		if period == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must be 1s, 5s, 10s, 30s or a positive multiple of 60s, got %s", name, period)
+}
+
+/*
+ * Check statistic and extended statistic names
+ */
+func checkStatistics(statistics []string, extended []string) error {
+	for _, statistic := range statistics {
+		if !contains(defaultStatistics, statistic) {
+			return fmt.Errorf("invalid statistic %q, must be one of %s", statistic, strings.Join(defaultStatistics, ", "))
+		}
+	}
+
+	if len(extended) > maxExtendedStatistics {
+		return fmt.Errorf("at most %d extended statistics can be requested, got %d", maxExtendedStatistics, len(extended))
+	}
+	for _, statistic := range extended {
+		if !isPercentile(statistic) {
+			return fmt.Errorf("invalid extended statistic %q, must be a percentile between p0.0 and p100", statistic)
+		}
+	}
+	return nil
+}
+
+func isPercentile(statistic string) bool {
+	if !percentileRegexp.MatchString(statistic) {
+		return false
+	}
+	p, err := strconv.ParseFloat(statistic[1:], 64)
+	return err == nil && p >= 0 && p <= 100
+}
+
+func init() {
+	inputs.Add("cloudwatch", func() telegraf.Input {
+		return &CloudWatch{
+			CacheTTL: internal.Duration{Duration: time.Hour},
+
+			Ec2TagCacheTTL:        internal.Duration{Duration: 24 * time.Hour},
+			Ec2TagRefreshInterval: internal.Duration{Duration: 5 * time.Minute},
+			RateLimit:             10,
+			Timeout:               internal.Duration{Duration: 30 * time.Second},
+		}
+	})
+}
+
+/*
+ * Initialize the CloudWatch clients of every region
+ */
+func (c *CloudWatch) initializeCloudWatch() error {
+	if c.Region == "" && len(c.Regions) == 0 {
+		c.detectRegion()
+	}
+
+	c.clients = map[string]cloudwatchClient{}
+	c.ec2Clients = map[string]ec2Client{}
+	c.rdsClients = map[string]rdsClient{}
+	c.resourceTagsClients = map[string]resourceTagsClient{}
+	for _, region := range c.regions() {
+		c.initializeRegion(region)
+	}
+	return nil
+}
+
+/*
+ * Create the clients missing once some were set, e.g. with SetClient, so
+ * that no request is made with a nil client
+ */
+func (c *CloudWatch) initializeMissingClients() {
+	if c.ec2Clients == nil {
+		c.ec2Clients = map[string]ec2Client{}
+	}
+	if c.rdsClients == nil {
+		c.rdsClients = map[string]rdsClient{}
+	}
+	if c.resourceTagsClients == nil {
+		c.resourceTagsClients = map[string]resourceTagsClient{}
+	}
+	for _, region := range c.regions() {
+		c.initializeRegion(region)
+	}
+}
+
+/*
+ * Record that the credentials of the clients expired when given request error
+ * is an expired token error, e.g. of assumed role credentials the SDK failed
+ * to refresh
+ */
+func (c *CloudWatch) checkCredentials(err error) {
+	if !isExpiredTokenError(err) {
+		return
+	}
+	c.mu.Lock()
+	c.credentialsExpired = true
+	c.mu.Unlock()
+}
+
+/*
+ * Create the clients again, along with their credentials, once a request of
+ * the gather failed with expired credentials. The clients set, e.g. with
+ * SetClient, are kept.
+ */
+func (c *CloudWatch) renewExpiredCredentials() {
+	c.mu.Lock()
+	expired := c.credentialsExpired
+	c.credentialsExpired = false
+	c.mu.Unlock()
+
+	if !expired {
+		return
+	}
+	log.Printf("W! CloudWatch credentials expired, renewing the clients")
+	for region := range c.clients {
+		if !c.injectedClients[region] {
+			delete(c.clients, region)
+		}
+	}
+	for region := range c.ec2Clients {
+		if !c.injectedEc2Clients[region] {
+			delete(c.ec2Clients, region)
+		}
+	}
+	c.rdsClients = nil
+	c.resourceTagsClients = nil
+	c.stsc = nil
+	c.initializeMissingClients()
+}
+
+func isExpiredTokenError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return contains(expiredTokenCodes, aerr.Code())
+	}
+	return false
+}
+
+// SetClient sets the CloudWatch client of given region, e.g. a fake client
+// in tests, instead of creating it from the credentials on the first Gather.
+// The clients that are not set, e.g. of other regions, are still created,
+// and the ones set are kept when expired credentials are renewed.
+func (c *CloudWatch) SetClient(region string, client cloudwatchiface.CloudWatchAPI) {
+	c.injectClient(region, client)
+}
+
+/*
+ * Set the CloudWatch client of given region, keeping it when renewing the
+ * credentials
+ */
+func (c *CloudWatch) injectClient(region string, client cloudwatchClient) {
+	if c.clients == nil {
+		c.clients = map[string]cloudwatchClient{}
+	}
+	if c.injectedClients == nil {
+		c.injectedClients = map[string]bool{}
+	}
+	c.clients[region] = client
+	c.injectedClients[region] = true
+}
+
+// SetEc2Client sets the EC2 client of given region used to fetch instance
+// tags when 'enrich_ec2_tags' is enabled, along with SetClient.
+func (c *CloudWatch) SetEc2Client(region string, client ec2iface.EC2API) {
+	c.injectEc2Client(region, client)
+}
+
+/*
+ * Set the EC2 client of given region, keeping it when renewing the
+ * credentials
+ */
+func (c *CloudWatch) injectEc2Client(region string, client ec2Client) {
+	if c.ec2Clients == nil {
+		c.ec2Clients = map[string]ec2Client{}
+	}
+	if c.injectedEc2Clients == nil {
+		c.injectedEc2Clients = map[string]bool{}
+	}
+	c.ec2Clients[region] = client
+	c.injectedEc2Clients[region] = true
+}
+
+/*
+ * Set the region to the one of the EC2 instance running the agent when none
+ * is configured
+ */
+func (c *CloudWatch) detectRegion() {
+	lookup := c.metadataRegion
+	if lookup == nil {
+		lookup = c.credentialConfig("").MetadataRegion
+	}
+	region, err := lookup()
+	if err != nil {
+		log.Printf("E! Unable to detect the region from the EC2 instance metadata, region must be set: %s", err)
+		return
+	}
+	log.Printf("D! CloudWatch region %s detected from the EC2 instance metadata", region)
+	c.Region = region
+}
+
+/*
+ * Build the credential config of the clients of given region
+ */
+func (c *CloudWatch) credentialConfig(region string) *internalaws.CredentialConfig {
+	return &internalaws.CredentialConfig{
+		Region:    region,
+		AccessKey: c.AccessKey,
+		SecretKey: c.SecretKey,
+		RoleARN:   c.RoleARN,
+		Profile:   c.Profile,
+		Filename:  c.Filename,
+		Token:     c.Token,
+
+		RoleARNs:        c.RoleARNs,
+		RoleExternalID:  c.RoleExternalID,
+		RoleSessionName: c.RoleSessionName,
+
+		IMDSv2:       c.IMDSv2,
+		IMDSEndpoint: c.IMDSEndpoint,
+
+		SharedConfig: c.SharedConfig,
+
+		UseFIPSEndpoint: c.UseFIPSEndpoint,
+	}
+}
+
+/*
+ * Initialize the clients of given region, keeping the ones already set, e.g.
+ * with SetClient
+ */
+func (c *CloudWatch) initializeRegion(region string) {
+	// the credentials are only built when a client is missing
+	var configProvider client.ConfigProvider
+	provider := func() client.ConfigProvider {
+		if configProvider == nil {
+			configProvider = c.credentialConfig(region).Credentials()
+		}
+		return configProvider
+	}
+
+	// the endpoint is only set on the service clients so that STS requests
+	// made to assume a role still use the default endpoint
+	config := &aws.Config{}
+	if c.EndpointURL != "" {
+		config.Endpoint = aws.String(c.EndpointURL)
+	}
+	stsConfig := &aws.Config{}
+	if c.UseFIPSEndpoint {
+		config.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+		stsConfig.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	if c.proxyURL != nil {
+		config.HTTPClient = &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(c.proxyURL)},
+		}
+		stsConfig.HTTPClient = config.HTTPClient
+	}
+
+	if _, ok := c.clients[region]; !ok {
+		if len(c.CredentialSets) > 0 {
+			c.clients[region] = c.newRoundRobinClient(region, config)
+		} else {
+			c.clients[region] = cloudwatch.New(provider(), config)
+		}
+	}
+	if _, ok := c.ec2Clients[region]; !ok && c.EnrichEc2Tags {
+		c.ec2Clients[region] = ec2.New(provider(), config)
+	}
+	if _, ok := c.rdsClients[region]; !ok && c.EnrichRdsTags {
+		c.rdsClients[region] = rds.New(provider(), config)
+	}
+	if _, ok := c.resourceTagsClients[region]; !ok && (c.EnrichResourceTags || len(c.ResourceTagFilters) > 0) {
+		c.resourceTagsClients[region] = resourcegroupstaggingapi.New(provider(), config)
+	}
+	// the account is the same whatever the region
+	if c.AccountIDTag && c.stsc == nil {
+		c.stsc = sts.New(provider(), stsConfig)
+	}
+}
+
+/*
+ * Create the context of a single API request, cancelled once the configured
+ * timeout expires
+ */
+func (c *CloudWatch) requestContext() (context.Context, context.CancelFunc) {
+	if c.Timeout.Duration <= 0 {
+		return context.WithCancel(c.context())
+	}
+	return context.WithTimeout(c.context(), c.Timeout.Duration)
+}
+
+/*
+ * Resolve the context of the plugin, cancelled once it is stopped, or the
+ * background context when it was not started, e.g. with 'telegraf --test'
+ */
+func (c *CloudWatch) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+/*
+ * Resolve the regions to collect, the single region option first
+ */
+func (c *CloudWatch) regions() []string {
+	if contains(c.Regions, c.Region) || (c.Region == "" && len(c.Regions) > 0) {
+		return c.Regions
+	}
+	return append([]string{c.Region}, c.Regions...)
+}
+
+/*
+ * Fetch available metrics for all configured CloudWatch Namespaces of every
+ * region, having the given dimensions if any
+ */
+func (c *CloudWatch) fetchNamespaceMetrics(dimensions []*Dimension) ([]*SelectedMetric, error) {
+	regions := c.regions()
+	filters := listDimensionFilters(dimensions)
+
+	// list namespaces concurrently, keeping the results in region and
+	// namespace order
+	results := make([][]*cloudwatch.Metric, len(regions)*len(c.Namespaces))
+	accounts := make([][]string, len(results))
+	errChan := errchan.New(len(results))
+
+	lmtr := limiter.NewRateLimiter(c.RateLimit, time.Second)
+	defer lmtr.Stop()
+	var wg sync.WaitGroup
+	wg.Add(len(results))
+	for i, region := range regions {
+		for j, namespace := range c.Namespaces {
+			go func(i int, region string, namespace string) {
+				defer wg.Done()
+				metrics, owners, err := c.fetchMetrics(region, namespace, filters, lmtr.C)
+				results[i] = metrics
+				accounts[i] = owners
+				errChan.C <- err
+			}(i*len(c.Namespaces)+j, region, namespace)
+		}
+	}
+	wg.Wait()
+
+	if err := errChan.Error(); err != nil {
+		return nil, err
+	}
+
+	metrics := []*SelectedMetric{}
+	for i, namespaceMetrics := range results {
+		for k, metric := range namespaceMetrics {
+			selected := &SelectedMetric{
+				Metric: metric,
+				Region: regions[i/len(c.Namespaces)],
+			}
+			if k < len(accounts[i]) {
+				selected.AccountID = accounts[i][k]
+			}
+			metrics = append(metrics, selected)
+		}
+	}
 	return metrics, nil
 }
 
 /*
- * Gather given Metric and emit any error
+ * Fetch available metrics for given CloudWatch Namespace of given region
+ * matching the dimension filters, along with their owning accounts when
+ * listing linked accounts, waiting for a token of the rate limiter before
+ * each page
+ */
+func (c *CloudWatch) fetchMetrics(
+	region string,
+	namespace string,
+	filters []*cloudwatch.DimensionFilter,
+	tokens <-chan bool,
+) ([]*cloudwatch.Metric, []string, error) {
+	key := c.listingKey(namespace, filters)
+
+	c.mu.Lock()
+	cache, ok := c.metricCache[region][key]
+	c.mu.Unlock()
+	if ok && cache.IsValid() {
+		return cache.Metrics, cache.Accounts, nil
+	}
+
+	metrics := []*cloudwatch.Metric{}
+	var accounts []string
+
+	var token *string
+	for more := true; more; {
+		params := &cloudwatch.ListMetricsInput{
+			Namespace:  aws.String(namespace),
+			Dimensions: filters,
+			NextToken:  token,
+			MetricName: nil,
+		}
+		if c.RecentlyActive {
+			params.RecentlyActive = aws.String(cloudwatch.RecentlyActivePt3h)
+		}
+		if c.LinkedAccounts {
+			params.IncludeLinkedAccounts = aws.Bool(true)
+		}
+
+		<-tokens
+		ctx, cancel := c.requestContext()
+		resp, err := c.clients[region].ListMetricsWithContext(ctx, params)
+		cancel()
+		c.countAPICall(region, namespace, err)
+		c.checkCredentials(err)
+		if err != nil {
+			// keep gathering the expired listing, e.g. while throttled
+			if ok && cache.fetched {
+				log.Printf("W! Error listing CloudWatch metrics of namespace %s in region %s, using the listing cached %s ago: %s",
+					namespace, region, time.Since(cache.Fetched), err)
+				return cache.Metrics, cache.Accounts, nil
+			}
+			return nil, nil, err
+		}
+
+		metrics = append(metrics, resp.Metrics...)
+		if c.LinkedAccounts {
+			accounts = append(accounts, aws.StringValueSlice(resp.OwningAccounts)...)
+		}
+
+		token = resp.NextToken
+		more = token != nil
+	}
+
+	c.mu.Lock()
+	if c.metricCache == nil {
+		c.metricCache = map[string]map[string]*MetricCache{}
+	}
+	if c.metricCache[region] == nil {
+		c.metricCache[region] = map[string]*MetricCache{}
+	}
+	c.metricCache[region][key] = &MetricCache{
+		Metrics:  metrics,
+		Accounts: accounts,
+		Fetched:  time.Now(),
+		TTL:      c.CacheTTL.Duration,
+		fetched:  true,
+	}
+	if c.MetricCacheFile != "" {
+		if err := c.saveMetricCache(); err != nil {
+			log.Printf("E! Unable to save the CloudWatch metric cache file %s: %s", c.MetricCacheFile, err)
+		}
+	}
+	c.mu.Unlock()
+
+	return metrics, accounts, nil
+}
+
+/*
+ * Gather given Metric and emit any error
+ */
+func (c *CloudWatch) gatherMetric(
+	acc telegraf.Accumulator,
+	metric *SelectedMetric,
+	now time.Time,
+	errChan chan error,
+) {
+	input := c.getStatisticsInput(metric, now)
+	datapoints := []*cloudwatch.Datapoint{}
+	for _, window := range splitTimeframe(input) {
+		for _, params := range splitStatisticsInput(window) {
+			ctx, cancel := c.requestContext()
+			resp, err := c.clients[metric.Region].GetMetricStatisticsWithContext(ctx, params)
+			cancel()
+			c.countAPICall(metric.Region, *metric.Namespace, err)
+			c.checkCredentials(err)
+			if err != nil {
+				errChan <- &metricsError{metrics: []*SelectedMetric{metric}, err: err}
+				return
+			}
+			datapoints = append(datapoints, resp.Datapoints...)
+		}
+	}
+	if len(datapoints) == 0 {
+		c.countEmptyMetrics(metric.Region, 1)
+	}
+
+	points := c.fillDatapoints(metric, input, mergeDatapoints(datapoints))
+	if c.OnlyNewDatapoints {
+		points = c.newDatapoints(metric, points)
+	}
+
+	gathered := 0
+	for _, point := range points {
+		tags := c.metricTags(metric)
+		if c.LabelTemplate != "" {
+			tags[labelTag] = c.expandLabel(metric)
+		}
+		if !c.OmitUnitNone || *point.Unit != cloudwatch.StandardUnitNone {
+			tags["unit"] = c.unitTag(*point.Unit)
+		}
+
+		values := c.datapointValues(metric, point)
+		if c.StatisticAsTag {
+			// record a point for each requested statistic
+			tags["metric_name"] = snakeCase(*metric.MetricName)
+			for _, v := range values {
+				statisticTags := make(map[string]string, len(tags)+1)
+				for k, tag := range tags {
+					statisticTags[k] = tag
+				}
+				statisticTags["statistic"] = c.statisticLabel(v.statistic)
+				fields := map[string]interface{}{statisticValueField: c.fieldValue(v.statistic, *point.Unit, v.value)}
+				c.addTimestamp(fields, *point.Timestamp)
+				acc.AddFields(c.measurementName(metric), fields, statisticTags, *point.Timestamp)
+			}
+			gathered += len(values)
+			continue
+		}
+
+		// record field for each requested statistic
+		fields := map[string]interface{}{}
+		for _, v := range values {
+			setField(fields, c.fieldName(metric, v.statistic), c.fieldValue(v.statistic, *point.Unit, v.value))
+		}
+		c.addTimestamp(fields, *point.Timestamp)
+
+		acc.AddFields(c.measurementName(metric), fields, tags, *point.Timestamp)
+		gathered++
+	}
+	c.countGathered(metric.Region, *metric.Namespace, gathered)
+
+	errChan <- nil
+}
+
+/*
+ * Keep the Datapoints of given Metric newer than the last one gathered
+ */
+func (c *CloudWatch) newDatapoints(metric *SelectedMetric, datapoints []*cloudwatch.Datapoint) []*cloudwatch.Datapoint {
+	key := metric.key()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last, ok := c.lastTimestamps[key]
+	latest := last
+	newer := make([]*cloudwatch.Datapoint, 0, len(datapoints))
+	for _, point := range datapoints {
+		if ok && !point.Timestamp.After(last) {
+			continue
+		}
+		newer = append(newer, point)
+		if point.Timestamp.After(latest) {
+			latest = *point.Timestamp
+		}
+	}
+
+	if len(newer) > 0 {
+		if c.lastTimestamps == nil {
+			c.lastTimestamps = map[string]time.Time{}
+		}
+		c.lastTimestamps[key] = latest
+	}
+	return newer
+}
+
+/*
+ * Count Metrics of given region that returned no datapoints during the
+ * current gather
+ */
+func (c *CloudWatch) countEmptyMetrics(region string, n int) {
+	c.mu.Lock()
+	c.emptyMetrics[region] += n
+	c.mu.Unlock()
+}
+
+/*
+ * Report the Metrics that returned no datapoints during the gather, which
+ * usually means the delay is too short for them
+ */
+func (c *CloudWatch) reportEmptyMetrics(total int) {
+	empty := 0
+	for _, n := range c.emptyMetrics {
+		empty += n
+	}
+	if empty > 0 {
+		log.Printf("D! %d of %d CloudWatch metrics returned no datapoints, consider increasing the delay", empty, total)
+	}
+	for region, stat := range c.emptyStats {
+		stat.Set(int64(c.emptyMetrics[region]))
+	}
+}
+
+/*
+ * Gather given Metrics in batches using the GetMetricData API
+ */
+func (c *CloudWatch) gatherMetricData(
+	acc telegraf.Accumulator,
+	metrics []*SelectedMetric,
+	now time.Time,
+) error {
+	batches := c.getMetricDataBatches(metrics, now)
+	regions := []string{}
+	if len(c.MetricMath) > 0 {
+		regions = c.regions()
+	}
+	errChan := errchan.New(len(batches) + len(regions))
+
+	// the rate limit applies to every GetMetricData request, including the
+	// pages of a batch, rather than to every metric
+	lmtr := limiter.NewRateLimiter(c.RateLimit, time.Second)
+	defer lmtr.Stop()
+	var wg sync.WaitGroup
+	wg.Add(len(batches) + len(regions))
+	for _, b := range batches {
+		go func(inb *metricDataBatch) {
+			defer wg.Done()
+			c.gatherMetricDataBatch(acc, inb, lmtr.C, errChan.C)
+		}(b)
+	}
+	// metric math expressions are evaluated in a request of their own
+	for _, region := range regions {
+		go func(region string) {
+			defer wg.Done()
+			c.gatherMetricMath(acc, region, now, lmtr.C, errChan.C)
+		}(region)
+	}
+	wg.Wait()
+
+	return gatherError(errChan, len(metrics))
+}
+
+/*
+ * Gather a single batch of GetMetricData queries and emit any error, waiting
+ * for a token of the rate limiter before each request
+ */
+func (c *CloudWatch) gatherMetricDataBatch(
+	acc telegraf.Accumulator,
+	batch *metricDataBatch,
+	tokens <-chan bool,
+	errChan chan error,
+) {
+	params := &cloudwatch.GetMetricDataInput{
+		StartTime:         aws.Time(batch.start),
+		EndTime:           aws.Time(batch.end),
+		MetricDataQueries: make([]*cloudwatch.MetricDataQuery, 0, len(batch.queries)),
+	}
+	for id, q := range batch.queries {
+		if q.band != "" {
+			params.MetricDataQueries = append(params.MetricDataQueries, &cloudwatch.MetricDataQuery{
+				Id:         aws.String(id),
+				Expression: aws.String(anomalyBandExpression(q.band, q.metric.Filter.AnomalyBand)),
+			})
+			continue
+		}
+		params.MetricDataQueries = append(params.MetricDataQueries, &cloudwatch.MetricDataQuery{
+			Id:        aws.String(id),
+			AccountId: accountID(q.metric),
+			Label:     c.labelTemplate(),
+			MetricStat: &cloudwatch.MetricStat{
+				Metric: q.metric.Metric,
+				Period: aws.Int64(int64(c.metricPeriod(q.metric).Seconds())),
+				Stat:   aws.String(q.statistic),
+				Unit:   c.metricUnit(q.metric),
+			},
+		})
+	}
+
+	// label of each metric as resolved by CloudWatch
+	labels := map[*SelectedMetric]string{}
+
+	// collect the fields of every statistic of a metric per timestamp so that
+	// each datapoint is emitted once, as with GetMetricStatistics
+	points := map[*SelectedMetric]map[time.Time]map[string]interface{}{}
+	for more := true; more; {
+		<-tokens
+		ctx, cancel := c.requestContext()
+		resp, err := c.clients[batch.region].GetMetricDataWithContext(ctx, params)
+		cancel()
+		for _, namespace := range batch.namespaces() {
+			c.countAPICall(batch.region, namespace, err)
+		}
+		c.checkCredentials(err)
+		if err != nil {
+			errChan <- &metricsError{metrics: batch.metrics(), err: err}
+			return
+		}
+
+		for _, result := range resp.MetricDataResults {
+			q, ok := batch.queries[*result.Id]
+			if !ok {
+				continue
+			}
+			if points[q.metric] == nil {
+				points[q.metric] = map[time.Time]map[string]interface{}{}
+			}
+			if c.LabelTemplate != "" && result.Label != nil && q.band == "" {
+				labels[q.metric] = *result.Label
+			}
+			for i, timestamp := range result.Timestamps {
+				if i >= len(result.Values) {
+					break
+				}
+				fields, ok := points[q.metric][*timestamp]
+				if !ok {
+					fields = map[string]interface{}{}
+					points[q.metric][*timestamp] = fields
+				}
+				if q.band != "" {
+					setBandField(fields, c.fieldName(q.metric, q.statistic), *result.Values[i])
+					continue
+				}
+				setField(fields, c.fieldName(q.metric, q.statistic), c.fieldValue(q.statistic, "", *result.Values[i]))
+				c.addRate(q.metric, q.statistic, *result.Values[i], fields)
+			}
+		}
+
+		params.NextToken = resp.NextToken
+		more = resp.NextToken != nil
+	}
+
+	for metric, timestamps := range points {
+		for timestamp, fields := range timestamps {
+			c.addTimestamp(fields, timestamp)
+			tags := c.metricTags(metric)
+			if label, ok := labels[metric]; ok {
+				tags[labelTag] = label
+			}
+			acc.AddFields(c.measurementName(metric), fields, tags, timestamp)
+		}
+		c.countGathered(metric.Region, *metric.Namespace, len(timestamps))
+	}
+
+	empty := map[*SelectedMetric]bool{}
+	for _, q := range batch.queries {
+		if len(points[q.metric]) == 0 && !empty[q.metric] {
+			empty[q.metric] = true
+			c.countEmptyMetrics(q.metric.Region, 1)
+		}
+	}
+
+	errChan <- nil
+}
+
+/*
+ * Build the metric math expression of the anomaly detection band of given
+ * statistic query, the given number of standard deviations wide
+ */
+func anomalyBandExpression(id string, width float64) string {
+	return fmt.Sprintf("ANOMALY_DETECTION_BAND(%s, %s)", id, strconv.FormatFloat(width, 'f', -1, 64))
+}
+
+/*
+ * Set the upper and lower band fields of given field from a value of its
+ * anomaly detection band, which CloudWatch returns as two time series of the
+ * same query id, the upper one having the greater values
+ */
+func setBandField(fields map[string]interface{}, name string, value float64) {
+	upper, lower := name+"_band_upper", name+"_band_lower"
+	if v, ok := fields[upper].(float64); !ok || value > v {
+		fields[upper] = value
+	}
+	if v, ok := fields[lower].(float64); !ok || value < v {
+		fields[lower] = value
+	}
+}
+
+/*
+ * List the distinct Metrics of the queries of a batch
+ */
+func (b *metricDataBatch) metrics() []*SelectedMetric {
+	metrics := []*SelectedMetric{}
+	seen := map[*SelectedMetric]bool{}
+	for _, q := range b.queries {
+		if !seen[q.metric] {
+			seen[q.metric] = true
+			metrics = append(metrics, q.metric)
+		}
+	}
+	return metrics
+}
+
+/*
+ * List the distinct namespaces of the Metrics queried by the batch
+ */
+func (b *metricDataBatch) namespaces() []string {
+	namespaces := []string{}
+	for _, metric := range b.metrics() {
+		if !contains(namespaces, *metric.Namespace) {
+			namespaces = append(namespaces, *metric.Namespace)
+		}
+	}
+	return namespaces
+}
+
+/*
+ * Map Metrics to batches of GetMetricData queries sharing the same timeframe
+ */
+func (c *CloudWatch) getMetricDataBatches(metrics []*SelectedMetric, now time.Time) []*metricDataBatch {
+	batches := []*metricDataBatch{}
+	// batch currently being filled for each region and timeframe
+	open := map[metricDataWindow]*metricDataBatch{}
+	id := 0
+	for _, metric := range metrics {
+		end := c.metricEnd(metric, now)
+		start := c.metricStart(metric, end)
+		window := metricDataWindow{region: metric.Region, start: start, end: end}
+
+		statistics := []string{}
+		statistics = append(statistics, c.metricStatistics(metric)...)
+		statistics = append(statistics, c.metricExtendedStatistics(metric)...)
+
+		// keep all statistics of a metric, and their bands, in the same batch
+		queries := len(statistics)
+		if metric.Filter != nil && metric.Filter.AnomalyBand > 0 {
+			queries *= 2
+		}
+		batch, ok := open[window]
+		if !ok || len(batch.queries)+queries > maxMetricDataQueries {
+			batch = &metricDataBatch{
+				metricDataWindow: window,
+				queries:          map[string]metricDataQuery{},
+			}
+			open[window] = batch
+			batches = append(batches, batch)
+		}
+		for _, statistic := range statistics {
+			// query ids must start with a lowercase letter
+			statID := "m" + strconv.Itoa(id)
+			batch.queries[statID] = metricDataQuery{
+				metric:    metric,
+				statistic: statistic,
+			}
+			if queries > len(statistics) {
+				batch.queries["b"+strconv.Itoa(id)] = metricDataQuery{
+					metric:    metric,
+					statistic: statistic,
+					band:      statID,
+				}
+			}
+			id++
+		}
+	}
+	return batches
+}
+
+/*
+ * Build the tags common to every datapoint of the given Metric
+ */
+func (c *CloudWatch) metricTags(metric *SelectedMetric) map[string]string {
+	tags := map[string]string{}
+	if !c.OmitRegionTag {
+		tags["region"] = metric.Region
+	}
+
+	if c.accountID != "" {
+		tags["account_id"] = c.accountID
+	}
+
+	if c.EnrichEc2Tags {
+		c.addEc2Tags(metric, tags)
+	}
+	if c.EnrichRdsTags {
+		c.addRdsTags(metric, tags)
+	}
+	if c.EnrichResourceTags {
+		c.addResourceTags(metric, tags)
+	}
+
+	if c.FieldNaming == fieldNamingStatisticOnly {
+		tags["metric_name"] = snakeCase(*metric.MetricName)
+	}
+
+	// the metrics of linked accounts are tagged with their source account
+	if metric.AccountID != "" {
+		tags["account_id"] = metric.AccountID
+	}
+
+	for _, d := range metric.Dimensions {
+		tags[c.dimensionTag(*d.Name)] = *d.Value
+	}
+
+	if c.PeriodTag {
+		tags["period"] = strconv.FormatInt(int64(c.metricPeriod(metric).Seconds()), 10)
+	}
+
+	if metric.Filter != nil && metric.Filter.Label != "" {
+		tags["label"] = metric.Filter.Label
+	}
+
+	for _, derivation := range c.TagDerivations {
+		derivation.apply(tags)
+	}
+	return tags
+}
+
+/*
+ * Copy the enriched tags of a resource to the tags of a metric, skipping the
+ * empty ones when enabled
+ */
+func (c *CloudWatch) copyTags(tags map[string]string, resourceTags map[string]string) {
+	for k, v := range resourceTags {
+		if v == "" && c.SkipEmptyTags {
+			continue
+		}
+		tags[k] = v
+	}
+}
+
+/*
+ * Resolve the label template sent with GetMetricData queries, if any
+ */
+func (c *CloudWatch) labelTemplate() *string {
+	if c.LabelTemplate == "" {
+		return nil
+	}
+	return aws.String(c.LabelTemplate)
+}
+
+/*
+ * Resolve the PROP placeholders of the label template for given Metric as
+ * CloudWatch does, keeping the unknown ones
+ */
+func (c *CloudWatch) expandLabel(metric *SelectedMetric) string {
+	return labelPropRegexp.ReplaceAllStringFunc(c.LabelTemplate, func(placeholder string) string {
+		prop := labelPropRegexp.FindStringSubmatch(placeholder)[1]
+		switch prop {
+		case "MetricName":
+			return aws.StringValue(metric.MetricName)
+		case "Namespace":
+			return aws.StringValue(metric.Namespace)
+		case "Period":
+			return strconv.FormatInt(int64(c.metricPeriod(metric).Seconds()), 10)
+		case "Region":
+			return metric.Region
+		}
+		if strings.HasPrefix(prop, "Dim.") {
+			for _, d := range metric.Dimensions {
+				if aws.StringValue(d.Name) == prop[len("Dim."):] {
+					return aws.StringValue(d.Value)
+				}
+			}
+		}
+		return placeholder
+	})
+}
+
+/*
+ * Resolve the tag name of given dimension
+ */
+func (c *CloudWatch) dimensionTag(name string) string {
+	tag := snakeCase(name)
+	for _, rename := range c.TagRenames {
+		if rename.From == name || rename.From == tag {
+			return rename.To
+		}
+	}
+	return tag
+}
+
+/*
+ * Compile the patterns of the configured tag derivations
+ */
+func (c *CloudWatch) compileTagDerivations() error {
+	for _, derivation := range c.TagDerivations {
+		if derivation.Delimiter != "" {
+			if derivation.Pattern != "" {
+				return fmt.Errorf("tag derivation of %q sets both a pattern and a delimiter", derivation.Source)
+			}
+			continue
+		}
+		if derivation.regexp != nil {
+			continue
+		}
+		re, err := regexp.Compile(derivation.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid tag derivation pattern %q: %s", derivation.Pattern, err)
+		}
+		derivation.regexp = re
+	}
+	return nil
+}
+
+/*
+ * Tell whether given tag key is added by an enabled EC2, RDS or resource tags
+ * enrichment, e.g. the Name tag only once listed in 'ec2_tag_keys'
  */
-func (c *CloudWatch) gatherMetric(
-	acc telegraf.Accumulator,
-	metric *cloudwatch.Metric,
-	now time.Time,
-	errChan chan error,
-) {
-	params := c.getStatisticsInput(metric, now)
-	resp, err := c.client.GetMetricStatistics(params)
-	if err != nil {
-		errChan <- err
+func (c *CloudWatch) isEnrichedTag(key string) bool {
+	return (c.EnrichEc2Tags && (contains(c.Ec2TagKeys, key) || key == availabilityZoneTag)) ||
+		(c.EnrichRdsTags && contains(c.RdsTagKeys, key)) ||
+		(c.EnrichResourceTags && contains(c.ResourceTagKeys, key))
+}
+
+/*
+ * Set the tags derived from the source tag, if present and matching, or
+ * split into as many parts as tags
+ */
+func (d *TagDerivation) apply(tags map[string]string) {
+	value, ok := tags[d.Source]
+	if !ok {
 		return
 	}
 
-	for _, point := range resp.Datapoints {
-		tags := map[string]string{
-			"region": c.Region,
-			"unit":   snakeCase(*point.Unit),
+	if d.Delimiter != "" {
+		parts := strings.Split(value, d.Delimiter)
+		if len(parts) != len(d.Tags) {
+			return
+		}
+		for i, tag := range d.Tags {
+			if parts[i] != "" {
+				tags[tag] = parts[i]
+			}
 		}
+		return
+	}
 
-		for _, d := range metric.Dimensions {
-			tags[snakeCase(*d.Name)] = *d.Value
+	match := d.regexp.FindStringSubmatch(value)
+	for i, tag := range d.Tags {
+		if i+1 < len(match) && match[i+1] != "" {
+			tags[tag] = match[i+1]
 		}
+	}
+}
 
-		// record field for each statistic
-		fields := map[string]interface{}{}
+/*
+ * Formatting helpers
+ */
+func formatField(metricName string, label string) string {
+	return fmt.Sprintf("%s_%s", snakeCase(metricName), label)
+}
 
-		if point.Average != nil {
-			fields[formatField(*metric.MetricName, cloudwatch.StatisticAverage)] = *point.Average
-		}
-		if point.Maximum != nil {
-			fields[formatField(*metric.MetricName, cloudwatch.StatisticMaximum)] = *point.Maximum
-		}
-		if point.Minimum != nil {
-			fields[formatField(*metric.MetricName, cloudwatch.StatisticMinimum)] = *point.Minimum
-		}
-		if point.SampleCount != nil {
-			fields[formatField(*metric.MetricName, cloudwatch.StatisticSampleCount)] = *point.SampleCount
+func formatMeasurement(namespace string) string {
+	return fmt.Sprintf("cloudwatch_%s", formatNamespace(namespace))
+}
+
+func formatNamespace(namespace string) string {
+	namespace = unsafeNamespaceRegexp.ReplaceAllString(namespace, "_")
+	namespace = underscoresRegexp.ReplaceAllString(snakeCase(namespace), "_")
+	return strings.Trim(namespace, "_")
+}
+
+/*
+ * Resolve the field name of a statistic of given Metric
+ */
+func (c *CloudWatch) fieldName(metric *SelectedMetric, statistic string) string {
+	if c.FieldNaming == fieldNamingStatisticOnly {
+		return c.statisticLabel(statistic)
+	}
+	return formatField(*metric.MetricName, c.statisticLabel(statistic))
+}
+
+/*
+ * Resolve the 'unit' tag of given unit, from 'unit_labels' or the snake cased
+ * unit
+ */
+func (c *CloudWatch) unitTag(unit string) string {
+	if label, ok := c.UnitLabels[unit]; ok {
+		return label
+	}
+	return snakeCase(unit)
+}
+
+/*
+ * Resolve the label of a statistic in field names and tags, from
+ * 'statistic_labels' or the snake cased statistic
+ */
+func (c *CloudWatch) statisticLabel(statistic string) string {
+	if label, ok := c.StatisticLabels[statistic]; ok {
+		return label
+	}
+	return snakeCase(statistic)
+}
+
+/*
+ * Collect the value of every requested statistic of given Datapoint, along
+ * with the rate when enabled
+ */
+func (c *CloudWatch) datapointValues(metric *SelectedMetric, point *cloudwatch.Datapoint) []statisticValue {
+	values := []statisticValue{}
+	for _, statistic := range c.metricStatistics(metric) {
+		if value := datapointValue(point, statistic); value != nil {
+			values = append(values, statisticValue{statistic: statistic, value: *value})
+			if rate, ok := c.rate(metric, statistic, *value); ok {
+				values = append(values, statisticValue{statistic: rateStatistic, value: rate})
+			}
 		}
-		if point.Sum != nil {
-			fields[formatField(*metric.MetricName, cloudwatch.StatisticSum)] = *point.Sum
+	}
+	for _, statistic := range c.metricExtendedStatistics(metric) {
+		if value, ok := point.ExtendedStatistics[statistic]; ok && value != nil {
+			values = append(values, statisticValue{statistic: statistic, value: *value})
 		}
+	}
+	return values
+}
 
-		acc.AddFields(formatMeasurement(c.Namespace), fields, tags, *point.Timestamp)
+/*
+ * Add the per second rate of given Sum value of a Metric to its fields when
+ * rates are enabled
+ */
+func (c *CloudWatch) addRate(metric *SelectedMetric, statistic string, value float64, fields map[string]interface{}) {
+	if rate, ok := c.rate(metric, statistic, value); ok {
+		setField(fields, c.fieldName(metric, rateStatistic), rate)
 	}
+}
 
-	errChan <- nil
+/*
+ * Add the original timestamp of a datapoint to its fields, in unix
+ * milliseconds, when enabled
+ */
+func (c *CloudWatch) addTimestamp(fields map[string]interface{}, timestamp time.Time) {
+	if c.TimestampField {
+		fields[timestampField] = timestamp.UnixNano() / int64(time.Millisecond)
+	}
 }
 
 /*
- * Formatting helpers
+ * Compute the per second rate of given Sum value of a Metric, if rates are
+ * enabled
  */
-func formatField(metricName string, statistic string) string {
-	return fmt.Sprintf("%s_%s", snakeCase(metricName), snakeCase(statistic))
+func (c *CloudWatch) rate(metric *SelectedMetric, statistic string, value float64) (float64, bool) {
+	if !c.EmitRate || statistic != cloudwatch.StatisticSum {
+		return 0, false
+	}
+	return value / c.metricPeriod(metric).Seconds(), true
 }
 
-func formatMeasurement(namespace string) string {
-	namespace = strings.Replace(namespace, "/", "_", -1)
-	namespace = snakeCase(namespace)
-	return fmt.Sprintf("cloudwatch_%s", namespace)
+/*
+ * Convert the value of a count statistic to an integer when enabled, i.e.
+ * SampleCount and the Sum of given unit when it is Count
+ */
+func (c *CloudWatch) fieldValue(statistic string, unit string, value float64) interface{} {
+	if c.CountAsInt && (statistic == cloudwatch.StatisticSampleCount ||
+		(statistic == cloudwatch.StatisticSum && unit == cloudwatch.StandardUnitCount)) {
+		return int64(value)
+	}
+	return value
+}
+
+/*
+ * Set given field, keeping the value already set when distinct names collide
+ * once snake cased, e.g. HTTPCode_Backend and HTTP_Code_Backend
+ */
+func setField(fields map[string]interface{}, name string, value interface{}) {
+	if _, ok := fields[name]; ok {
+		log.Printf("W! CloudWatch field %s is already set, ignoring the colliding value", name)
+		return
+	}
+	fields[name] = value
+}
+
+/*
+ * Resolve the measurement name of given Metric
+ */
+func (c *CloudWatch) measurementName(metric *SelectedMetric) string {
+	if metric.Filter != nil && metric.Filter.Measurement != "" {
+		return metric.Filter.Measurement
+	}
+	if c.Measurement != "" {
+		return c.Measurement
+	}
+	if c.MeasurementPrefix != "" {
+		return c.MeasurementPrefix + formatNamespace(*metric.Namespace)
+	}
+	return formatMeasurement(*metric.Namespace)
 }
 
 func snakeCase(s string) string {
@@ -350,56 +2745,430 @@ func snakeCase(s string) string {
 /*
  * Map Metric to *cloudwatch.GetMetricStatisticsInput for given timeframe
  */
-func (c *CloudWatch) getStatisticsInput(metric *cloudwatch.Metric, now time.Time) *cloudwatch.GetMetricStatisticsInput {
-	end := now.Add(-c.Delay.Duration)
+func (c *CloudWatch) getStatisticsInput(metric *SelectedMetric, now time.Time) *cloudwatch.GetMetricStatisticsInput {
+	period := c.metricPeriod(metric)
+	end := c.metricEnd(metric, now)
 
 	input := &cloudwatch.GetMetricStatisticsInput{
-		StartTime:  aws.Time(end.Add(-c.Period.Duration)),
+		StartTime:  aws.Time(c.metricStart(metric, end)),
 		EndTime:    aws.Time(end),
 		MetricName: metric.MetricName,
 		Namespace:  metric.Namespace,
-		Period:     aws.Int64(int64(c.Period.Duration.Seconds())),
+		Period:     aws.Int64(int64(period.Seconds())),
 		Dimensions: metric.Dimensions,
-		Statistics: []*string{
-			aws.String(cloudwatch.StatisticAverage),
-			aws.String(cloudwatch.StatisticMaximum),
-			aws.String(cloudwatch.StatisticMinimum),
-			aws.String(cloudwatch.StatisticSum),
-			aws.String(cloudwatch.StatisticSampleCount)},
+		Unit:       c.metricUnit(metric),
+	}
+	if statistics := c.metricStatistics(metric); len(statistics) > 0 {
+		input.Statistics = aws.StringSlice(statistics)
+	}
+	if extended := c.metricExtendedStatistics(metric); len(extended) > 0 {
+		input.ExtendedStatistics = aws.StringSlice(extended)
 	}
 	return input
 }
 
+/*
+ * Split the timeframe of an input into consecutive inputs of at most
+ * maxStatisticsDatapoints periods, which GetMetricStatistics rejects in a
+ * single request
+ */
+func splitTimeframe(input *cloudwatch.GetMetricStatisticsInput) []*cloudwatch.GetMetricStatisticsInput {
+	chunk := time.Duration(*input.Period) * time.Second * maxStatisticsDatapoints
+	if input.EndTime.Sub(*input.StartTime) <= chunk {
+		return []*cloudwatch.GetMetricStatisticsInput{input}
+	}
+
+	inputs := []*cloudwatch.GetMetricStatisticsInput{}
+	for start := *input.StartTime; start.Before(*input.EndTime); start = start.Add(chunk) {
+		end := start.Add(chunk)
+		if end.After(*input.EndTime) {
+			end = *input.EndTime
+		}
+		window := *input
+		window.StartTime = aws.Time(start)
+		window.EndTime = aws.Time(end)
+		inputs = append(inputs, &window)
+	}
+	return inputs
+}
+
+/*
+ * Split an input requesting both statistics and extended statistics, which
+ * GetMetricStatistics does not allow in a single request
+ */
+func splitStatisticsInput(input *cloudwatch.GetMetricStatisticsInput) []*cloudwatch.GetMetricStatisticsInput {
+	if len(input.Statistics) == 0 || len(input.ExtendedStatistics) == 0 {
+		return []*cloudwatch.GetMetricStatisticsInput{input}
+	}
+
+	extended := *input
+	extended.Statistics = nil
+	standard := *input
+	standard.ExtendedStatistics = nil
+	return []*cloudwatch.GetMetricStatisticsInput{&standard, &extended}
+}
+
+/*
+ * Merge Datapoints sharing the same timestamp, as returned by split requests
+ */
+func mergeDatapoints(datapoints []*cloudwatch.Datapoint) []*cloudwatch.Datapoint {
+	merged := []*cloudwatch.Datapoint{}
+	byTimestamp := map[time.Time]*cloudwatch.Datapoint{}
+	for _, point := range datapoints {
+		existing, ok := byTimestamp[*point.Timestamp]
+		if !ok {
+			byTimestamp[*point.Timestamp] = point
+			merged = append(merged, point)
+			continue
+		}
+
+		if point.Average != nil {
+			existing.Average = point.Average
+		}
+		if point.Maximum != nil {
+			existing.Maximum = point.Maximum
+		}
+		if point.Minimum != nil {
+			existing.Minimum = point.Minimum
+		}
+		if point.SampleCount != nil {
+			existing.SampleCount = point.SampleCount
+		}
+		if point.Sum != nil {
+			existing.Sum = point.Sum
+		}
+		for statistic, value := range point.ExtendedStatistics {
+			if existing.ExtendedStatistics == nil {
+				existing.ExtendedStatistics = map[string]*float64{}
+			}
+			existing.ExtendedStatistics[statistic] = value
+		}
+	}
+	return merged
+}
+
+/*
+ * Resolve the aggregation period of given Metric
+ */
+func (c *CloudWatch) metricPeriod(metric *SelectedMetric) time.Duration {
+	if metric.Filter != nil && metric.Filter.Period.Duration > 0 {
+		return metric.Filter.Period.Duration
+	}
+	return c.Period.Duration
+}
+
+/*
+ * Resolve the collection delay of given Metric
+ */
+func (c *CloudWatch) metricDelay(metric *SelectedMetric) time.Duration {
+	if metric.Filter != nil && metric.Filter.Delay.Duration > 0 {
+		return metric.Filter.Delay.Duration
+	}
+	if delay, ok := c.namespaceDelays[aws.StringValue(metric.Namespace)]; ok {
+		return delay
+	}
+	return c.Delay.Duration
+}
+
+/*
+ * Resolve the end of the timeframe requested for given Metric, aligned to
+ * the period if configured
+ */
+func (c *CloudWatch) metricEnd(metric *SelectedMetric, now time.Time) time.Time {
+	end := now.Add(-c.metricDelay(metric))
+	if c.AlignPeriods {
+		end = end.Truncate(c.metricPeriod(metric))
+	}
+	return end
+}
+
+/*
+ * Resolve the start of the timeframe to request for given Metric ending at
+ * given time, the backfill timeframe on the first gather
+ */
+func (c *CloudWatch) metricStart(metric *SelectedMetric, end time.Time) time.Time {
+	period := c.metricPeriod(metric)
+	if !c.backfilled && c.Backfill.Duration > period {
+		return end.Add(-c.Backfill.Duration)
+	}
+	return end.Add(-period)
+}
+
+/*
+ * Resolve the unit to request for given Metric, nil for any unit
+ */
+func (c *CloudWatch) metricUnit(metric *SelectedMetric) *string {
+	if metric.Filter != nil && metric.Filter.Unit != "" {
+		return aws.String(metric.Filter.Unit)
+	}
+	return nil
+}
+
+/*
+ * Resolve the statistics to request for given Metric
+ */
+func (c *CloudWatch) metricStatistics(metric *SelectedMetric) []string {
+	if metric.Filter != nil && len(metric.Filter.Statistics) > 0 {
+		return metric.Filter.Statistics
+	}
+	if statistics := c.NamespaceStatistics[aws.StringValue(metric.Namespace)]; len(statistics) > 0 {
+		return statistics
+	}
+	if len(c.Statistics) > 0 {
+		return c.Statistics
+	}
+	if len(c.metricExtendedStatistics(metric)) > 0 {
+		return nil
+	}
+	return defaultStatistics
+}
+
+/*
+ * Resolve the extended statistics (percentiles) to request for given Metric
+ */
+func (c *CloudWatch) metricExtendedStatistics(metric *SelectedMetric) []string {
+	if metric.Filter != nil && len(metric.Filter.ExtendedStatistics) > 0 {
+		return metric.Filter.ExtendedStatistics
+	}
+	return c.ExtendedStatistics
+}
+
+/*
+ * Read the value of given statistic from a Datapoint
+ */
+func datapointValue(point *cloudwatch.Datapoint, statistic string) *float64 {
+	switch statistic {
+	case cloudwatch.StatisticAverage:
+		return point.Average
+	case cloudwatch.StatisticMaximum:
+		return point.Maximum
+	case cloudwatch.StatisticMinimum:
+		return point.Minimum
+	case cloudwatch.StatisticSampleCount:
+		return point.SampleCount
+	case cloudwatch.StatisticSum:
+		return point.Sum
+	}
+	return nil
+}
+
 /*
  * Check Metric Cache validity
  */
 func (c *MetricCache) IsValid() bool {
-	return c.Metrics != nil && time.Since(c.Fetched) < c.TTL
+	return c.fetched && time.Since(c.Fetched) < c.TTL
+}
+
+/*
+ * Split the Metric filters having dimension sets into one filter per set,
+ * the dimensions of the filter being shared by each of them
+ */
+func expandDimensionSets(metrics []*Metric) []*Metric {
+	var expanded []*Metric
+	for _, m := range metrics {
+		if len(m.DimensionSets) == 0 {
+			expanded = append(expanded, m)
+			continue
+		}
+		for _, set := range m.DimensionSets {
+			filter := *m
+			filter.DimensionSets = nil
+			filter.Dimensions = make([]*Dimension, 0, len(m.Dimensions)+len(set.Dimensions))
+			filter.Dimensions = append(filter.Dimensions, m.Dimensions...)
+			filter.Dimensions = append(filter.Dimensions, set.Dimensions...)
+			expanded = append(expanded, &filter)
+		}
+	}
+	return expanded
+}
+
+/*
+ * Compile the metric name patterns of the Metric filter
+ */
+func (m *Metric) compileNamesRegex() error {
+	m.namesRegex = make([]*regexp.Regexp, 0, len(m.NamesRegex))
+	for _, pattern := range m.NamesRegex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid metric names_regex %q: %s", pattern, err)
+		}
+		m.namesRegex = append(m.namesRegex, re)
+	}
+	return nil
+}
+
+func (m *Metric) matchesNamesRegex(name string) bool {
+	for _, re := range m.namesRegex {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Identify the Metric by region, namespace, name and sorted dimensions
+ */
+func (m *SelectedMetric) key() string {
+	if m.AccountID != "" {
+		return m.Region + "/" + m.AccountID + "/" + metricKey(m.Metric)
+	}
+	return m.Region + "/" + metricKey(m.Metric)
+}
+
+/*
+ * Tell whether the Metric filter selects the metrics of the source account of
+ * given Metric
+ */
+func (m *Metric) selectsAccount(metric *SelectedMetric) bool {
+	return m.AccountID == "" || m.AccountID == metric.AccountID
+}
+
+/*
+ * Resolve the source account to query the metrics of linked accounts in
+ */
+func accountID(metric *SelectedMetric) *string {
+	if metric.AccountID == "" {
+		return nil
+	}
+	return aws.String(metric.AccountID)
+}
+
+/*
+ * Narrow the listing of the metrics of a filter to the ones having its
+ * dimensions, with exact values when they are not wildcards
+ */
+func listDimensionFilters(dimensions []*Dimension) []*cloudwatch.DimensionFilter {
+	filters := []*cloudwatch.DimensionFilter{}
+	if len(dimensions) > maxListDimensionFilters {
+		return filters
+	}
+	for _, d := range dimensions {
+		f := &cloudwatch.DimensionFilter{Name: aws.String(d.Name)}
+		if d.Value != "" && !isGlob(d.Value) {
+			f.Value = aws.String(d.Value)
+		}
+		filters = append(filters, f)
+	}
+	return filters
+}
+
+/*
+ * Identify the listing of a namespace by its sorted dimension filters, along
+ * with the options narrowing or widening it so that a listing persisted with
+ * other options is not used
+ */
+func (c *CloudWatch) listingKey(namespace string, filters []*cloudwatch.DimensionFilter) string {
+	key := namespace
+	if len(filters) > 0 {
+		dimensions := make([]string, len(filters))
+		for i, f := range filters {
+			dimensions[i] = aws.StringValue(f.Name)
+			if f.Value != nil {
+				dimensions[i] += "=" + *f.Value
+			}
+		}
+		sort.Strings(dimensions)
+		key += "/" + strings.Join(dimensions, ",")
+	}
+	if c.RecentlyActive {
+		key += ";recently_active"
+	}
+	if c.LinkedAccounts {
+		key += ";include_linked_accounts"
+	}
+	return key
+}
+
+/*
+ * Build a key uniquely identifying a Metric by namespace, name and dimensions
+ */
+func metricKey(metric *cloudwatch.Metric) string {
+	dimensions := make([]string, len(metric.Dimensions))
+	for i, d := range metric.Dimensions {
+		dimensions[i] = aws.StringValue(d.Name) + "=" + aws.StringValue(d.Value)
+	}
+	sort.Strings(dimensions)
+	return aws.StringValue(metric.Namespace) + "/" + aws.StringValue(metric.MetricName) + "/" + strings.Join(dimensions, ",")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Compile the Dimension value if it is a glob pattern
+ */
+func (d *Dimension) compileValueFilter() error {
+	if !isGlob(d.Value) {
+		return nil
+	}
+	f, err := filter.Compile([]string{d.Value})
+	if err != nil {
+		return fmt.Errorf("invalid dimension %s value pattern %q: %s", d.Name, d.Value, err)
+	}
+	d.valueFilter = f
+	return nil
+}
+
+func (d *Dimension) matches(value string) bool {
+	if d.Value == "" || d.Value == "*" {
+		return true
+	}
+	if d.valueFilter != nil {
+		return d.valueFilter.Match(value)
+	}
+	return d.Value == value
+}
+
+func isGlob(value string) bool {
+	return strings.ContainsAny(value, "*?[")
 }
 
 func hasWilcard(dimensions []*Dimension) bool {
 	for _, d := range dimensions {
-		if d.Value == "" || d.Value == "*" {
+		if d.Value == "" || isGlob(d.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Tell whether a dimension is given by name only, in which case metrics may
+ * have other dimensions than the configured ones
+ */
+func hasNameOnly(dimensions []*Dimension) bool {
+	for _, d := range dimensions {
+		if d.Value == "" {
 			return true
 		}
 	}
 	return false
 }
 
-func isSelected(name string, metric *cloudwatch.Metric, dimensions []*Dimension) bool {
+/*
+ * Tell whether a listed metric has the given name and dimensions, along with
+ * other dimensions when one of them is given by name only and the selection
+ * is not strict
+ */
+func isSelected(name string, metric *cloudwatch.Metric, dimensions []*Dimension, strict bool) bool {
 	if name != *metric.MetricName {
 		return false
 	}
-	if len(metric.Dimensions) != len(dimensions) {
+	if len(metric.Dimensions) != len(dimensions) && (strict || !hasNameOnly(dimensions)) {
 		return false
 	}
 	for _, d := range dimensions {
 		selected := false
 		for _, d2 := range metric.Dimensions {
-			if d.Name == *d2.Name {
-				if d.Value == "" || d.Value == "*" || d.Value == *d2.Value {
-					selected = true
-				}
+			if d.Name == *d2.Name && d.matches(*d2.Value) {
+				selected = true
 			}
 		}
 		if !selected {
@@ -1,19 +1,34 @@
 package cloudwatch
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/plugins/inputs"
 	"github.com/influxdata/telegraf/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
 type mockGatherCloudWatchClient struct{}
 
-func (m *mockGatherCloudWatchClient) ListMetrics(params *cloudwatch.ListMetricsInput) (*cloudwatch.ListMetricsOutput, error) {
+func (m *mockGatherCloudWatchClient) ListMetricsWithContext(ctx aws.Context, params *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
 	metric := &cloudwatch.Metric{
 		Namespace:  params.Namespace,
 		MetricName: aws.String("Latency"),
@@ -31,7 +46,7 @@ func (m *mockGatherCloudWatchClient) ListMetrics(params *cloudwatch.ListMetricsI
 	return result, nil
 }
 
-func (m *mockGatherCloudWatchClient) GetMetricStatistics(params *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+func (m *mockGatherCloudWatchClient) GetMetricStatisticsWithContext(ctx aws.Context, params *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
 	dataPoint := &cloudwatch.Datapoint{
 		Timestamp:   params.EndTime,
 		Minimum:     aws.Float64(0.1),
@@ -48,6 +63,25 @@ func (m *mockGatherCloudWatchClient) GetMetricStatistics(params *cloudwatch.GetM
 	return result, nil
 }
 
+func (m *mockGatherCloudWatchClient) GetMetricDataWithContext(ctx aws.Context, params *cloudwatch.GetMetricDataInput, opts ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	values := map[string]float64{
+		cloudwatch.StatisticMinimum:     0.1,
+		cloudwatch.StatisticMaximum:     0.3,
+		cloudwatch.StatisticAverage:     0.2,
+		cloudwatch.StatisticSum:         123,
+		cloudwatch.StatisticSampleCount: 100,
+	}
+	result := &cloudwatch.GetMetricDataOutput{}
+	for _, q := range params.MetricDataQueries {
+		result.MetricDataResults = append(result.MetricDataResults, &cloudwatch.MetricDataResult{
+			Id:         q.Id,
+			Timestamps: []*time.Time{params.EndTime},
+			Values:     []*float64{aws.Float64(values[*q.MetricStat.Stat])},
+		})
+	}
+	return result, nil
+}
+
 func TestGather(t *testing.T) {
 	duration, _ := time.ParseDuration("1m")
 	internalDuration := internal.Duration{
@@ -62,7 +96,7 @@ func TestGather(t *testing.T) {
 	}
 
 	var acc testutil.Accumulator
-	c.client = &mockGatherCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
 
 	c.Gather(&acc)
 
@@ -83,60 +117,128 @@ func TestGather(t *testing.T) {
 
 }
 
-type mockSelectMetricsCloudWatchClient struct{}
+func TestGatherMultipleNamespaces(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:     "us-east-1",
+		Namespace:  "AWS/ELB",
+		Namespaces: []string{"AWS/EC2"},
+		Delay:      internalDuration,
+		Period:     internalDuration,
+		RateLimit:  10,
+	}
 
-func (m *mockSelectMetricsCloudWatchClient) ListMetrics(params *cloudwatch.ListMetricsInput) (*cloudwatch.ListMetricsOutput, error) {
-	metrics := []*cloudwatch.Metric{}
-	// 4 metrics are available
-	metricNames := []string{"Latency", "RequestCount", "HealthyHostCount", "UnHealthyHostCount"}
-	// for 3 ELBs
-	loadBalancers := []string{"lb-1", "lb-2", "lb-3"}
-	// in 2 AZs
-	availabilityZones := []string{"us-east-1a", "us-east-1b"}
-	for _, m := range metricNames {
-		for _, lb := range loadBalancers {
-			// For each metric/ELB pair, we get an aggregate value across all AZs.
-			metrics = append(metrics, &cloudwatch.Metric{
-				Namespace:  aws.String("AWS/ELB"),
-				MetricName: aws.String(m),
-				Dimensions: []*cloudwatch.Dimension{
-					&cloudwatch.Dimension{
-						Name:  aws.String("LoadBalancerName"),
-						Value: aws.String(lb),
-					},
-				},
-			})
-			for _, az := range availabilityZones {
-				// We get a metric for each metric/ELB/AZ triplet.
-				metrics = append(metrics, &cloudwatch.Metric{
-					Namespace:  aws.String("AWS/ELB"),
-					MetricName: aws.String(m),
-					Dimensions: []*cloudwatch.Dimension{
-						&cloudwatch.Dimension{
-							Name:  aws.String("LoadBalancerName"),
-							Value: aws.String(lb),
-						},
-						&cloudwatch.Dimension{
-							Name:  aws.String("AvailabilityZone"),
-							Value: aws.String(az),
-						},
-					},
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	assert.Equal(t, []string{"AWS/ELB", "AWS/EC2"}, c.Namespaces)
+	assert.True(t, acc.HasMeasurement("cloudwatch_aws_elb"))
+	assert.True(t, acc.HasMeasurement("cloudwatch_aws_ec2"))
+	assert.Len(t, c.metricCache["us-east-1"], 2)
+}
+
+type mockHangingCloudWatchClient struct {
+	mockGatherCloudWatchClient
+}
+
+func (m *mockHangingCloudWatchClient) GetMetricStatisticsWithContext(ctx aws.Context, params *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestGatherTimeout(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Delay:     internalDuration,
+		Period:    internalDuration,
+		RateLimit: 10,
+		Timeout:   internal.Duration{Duration: time.Millisecond},
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockHangingCloudWatchClient{}}
+
+	// the hung request is cancelled instead of blocking the gather
+	assert.Error(t, c.Gather(&acc))
+	assert.Len(t, acc.Metrics, 0)
+}
+
+func TestGatherPartialErrors(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+
+	for _, useGetMetricData := range []bool{false, true} {
+		c := &CloudWatch{
+			Region:           "us-east-1",
+			Namespace:        "AWS/ELB",
+			Delay:            internalDuration,
+			Period:           internalDuration,
+			RateLimit:        10,
+			UseGetMetricData: useGetMetricData,
+		}
+
+		mock := &mockGatherCloudWatchClient{}
+		c.SetClientFuncs(c.Region, &ClientFuncs{
+			ListMetrics: func(ctx context.Context, params *cloudwatch.ListMetricsInput) (*cloudwatch.ListMetricsOutput, error) {
+				result, err := mock.ListMetricsWithContext(ctx, params)
+				result.Metrics = append(result.Metrics, &cloudwatch.Metric{
+					Namespace:  params.Namespace,
+					MetricName: aws.String("RequestCount"),
 				})
-			}
+				return result, err
+			},
+			GetMetricStatistics: func(ctx context.Context, params *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+				if *params.MetricName == "RequestCount" {
+					return nil, errors.New("throttled")
+				}
+				return mock.GetMetricStatisticsWithContext(ctx, params)
+			},
+			GetMetricData: func(ctx context.Context, params *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+				return nil, errors.New("throttled")
+			},
+		})
+
+		var acc testutil.Accumulator
+		err := c.Gather(&acc)
+		if useGetMetricData {
+			// both metrics are requested in the same batch
+			assert.EqualError(t, err, "2 of 2 metrics failed to be gathered: [throttled]")
+			continue
 		}
-	}
 
-	result := &cloudwatch.ListMetricsOutput{
-		Metrics: metrics,
+		// the datapoints of the other metric are still gathered
+		assert.EqualError(t, err, "1 of 2 metrics failed to be gathered: [throttled]")
+		assert.Len(t, acc.Metrics, 1)
 	}
-	return result, nil
 }
 
-func (m *mockSelectMetricsCloudWatchClient) GetMetricStatistics(params *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
-	return nil, nil
+func TestMetricName(t *testing.T) {
+	metric := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			Namespace:  aws.String("AWS/ELB"),
+			MetricName: aws.String("Latency"),
+			Dimensions: []*cloudwatch.Dimension{
+				&cloudwatch.Dimension{Name: aws.String("LoadBalancerName"), Value: aws.String("p-example")},
+			},
+		},
+		Region: "us-east-1",
+	}
+	assert.Equal(t, "us-east-1/AWS/ELB/Latency{LoadBalancerName=p-example}", metricName(metric))
 }
 
-func TestSelectMetrics(t *testing.T) {
+func TestGatherOverlapping(t *testing.T) {
 	duration, _ := time.ParseDuration("1m")
 	internalDuration := internal.Duration{
 		Duration: duration,
@@ -147,74 +249,2810 @@ func TestSelectMetrics(t *testing.T) {
 		Delay:     internalDuration,
 		Period:    internalDuration,
 		RateLimit: 10,
-		Metrics: []*Metric{
-			&Metric{
-				MetricNames: []string{"Latency", "RequestCount"},
-				Dimensions: []*Dimension{
-					&Dimension{
-						Name:  "LoadBalancerName",
-						Value: "*",
-					},
-					&Dimension{
-						Name:  "AvailabilityZone",
-						Value: "*",
-					},
-				},
-			},
-		},
 	}
-	c.client = &mockSelectMetricsCloudWatchClient{}
-	metrics, err := SelectMetrics(c)
-	// We've asked for 2 (out of 4) metrics, over all 3 load balancers in all 2
-	// AZs. We should get 12 metrics.
-	assert.Equal(t, 12, len(metrics))
-	assert.Nil(t, err)
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockHangingCloudWatchClient{}}
+	assert.NoError(t, c.Start(&acc))
+	defer c.Stop()
+
+	done := make(chan error)
+	go func() {
+		done <- c.Gather(&acc)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the next gather is skipped while the previous one is running
+	assert.NoError(t, c.Gather(&acc))
+	assert.Len(t, acc.Metrics, 0)
+
+	c.Stop()
+	assert.Error(t, <-done)
+
+	// and gathers again once it is done
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+	assert.NoError(t, c.Start(&acc))
+	assert.NoError(t, c.Gather(&acc))
+	assert.Len(t, acc.Metrics, 1)
 }
 
-func TestGenerateStatisticsInputParams(t *testing.T) {
-	d := &cloudwatch.Dimension{
-		Name:  aws.String("LoadBalancerName"),
-		Value: aws.String("p-example"),
+func TestGatherStopJitter(t *testing.T) {
+	c := &CloudWatch{
+		Region:       "us-east-1",
+		Namespace:    "AWS/ELB",
+		Period:       internal.Duration{Duration: time.Minute},
+		RateLimit:    10,
+		GatherJitter: internal.Duration{Duration: time.Hour},
 	}
 
-	m := &cloudwatch.Metric{
-		MetricName: aws.String("Latency"),
-		Dimensions: []*cloudwatch.Dimension{d},
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+	assert.NoError(t, c.Start(&acc))
+
+	done := make(chan error)
+	go func() {
+		done <- c.Gather(&acc)
+	}()
+
+	// stopping the plugin interrupts the jitter sleep, gathering nothing
+	time.Sleep(50 * time.Millisecond)
+	c.Stop()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("jitter sleep not interrupted by Stop")
+	}
+	assert.Len(t, acc.Metrics, 0)
+}
+
+func TestGatherStop(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Delay:     internalDuration,
+		Period:    internalDuration,
+		RateLimit: 10,
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockHangingCloudWatchClient{}}
+	assert.NoError(t, c.Start(&acc))
+
+	done := make(chan error)
+	go func() {
+		done <- c.Gather(&acc)
+	}()
+
+	// stopping the plugin cancels the requests in flight
+	time.Sleep(50 * time.Millisecond)
+	c.Stop()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("gather not cancelled by Stop")
+	}
+	assert.Len(t, acc.Metrics, 0)
+}
+
+type mockConcurrentCloudWatchClient struct {
+	mockSelectMetricsCloudWatchClient
+	mu       sync.Mutex
+	inflight int
+	max      int
+}
+
+func (m *mockConcurrentCloudWatchClient) GetMetricStatisticsWithContext(ctx aws.Context, params *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	m.mu.Lock()
+	m.inflight++
+	if m.inflight > m.max {
+		m.max = m.inflight
 	}
+	m.mu.Unlock()
 
+	time.Sleep(10 * time.Millisecond)
+
+	m.mu.Lock()
+	m.inflight--
+	m.mu.Unlock()
+	return &cloudwatch.GetMetricStatisticsOutput{}, nil
+}
+
+func TestGatherMaxConcurrentRequests(t *testing.T) {
 	duration, _ := time.ParseDuration("1m")
 	internalDuration := internal.Duration{
 		Duration: duration,
 	}
+	c := &CloudWatch{
+		Region:        "us-east-1",
+		Namespace:     "AWS/ELB",
+		Delay:         internalDuration,
+		Period:        internalDuration,
+		RateLimit:     1000,
+		MaxConcurrent: 2,
+	}
+
+	var acc testutil.Accumulator
+	client := &mockConcurrentCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: client}
+
+	assert.NoError(t, c.Gather(&acc))
+	assert.Equal(t, 2, client.max)
+}
+
+type mockNoDatapointsCloudWatchClient struct {
+	mockGatherCloudWatchClient
+}
+
+func (m *mockNoDatapointsCloudWatchClient) GetMetricStatisticsWithContext(ctx aws.Context, params *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	return &cloudwatch.GetMetricStatisticsOutput{}, nil
+}
 
+func TestGatherEmptyMetrics(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
 	c := &CloudWatch{
+		Region:    "eu-north-1",
 		Namespace: "AWS/ELB",
 		Delay:     internalDuration,
 		Period:    internalDuration,
+		RateLimit: 10,
 	}
 
-	c.initializeCloudWatch()
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockNoDatapointsCloudWatchClient{}}
 
-	now := time.Now()
+	assert.NoError(t, c.Gather(&acc))
+	assert.Len(t, acc.Metrics, 0)
+	assert.Equal(t, int64(1), c.emptyStats["eu-north-1"].Get())
 
-	params := c.getStatisticsInput(m, now)
+	// the count is reset on every gather
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+	assert.NoError(t, c.Gather(&acc))
+	assert.Equal(t, int64(0), c.emptyStats["eu-north-1"].Get())
+}
 
-	assert.EqualValues(t, *params.EndTime, now.Add(-c.Delay.Duration))
-	assert.EqualValues(t, *params.StartTime, now.Add(-c.Period.Duration).Add(-c.Delay.Duration))
-	assert.Len(t, params.Dimensions, 1)
-	assert.Len(t, params.Statistics, 5)
-	assert.EqualValues(t, *params.Period, 60)
+func TestGatherEmptyMetricsRegions(t *testing.T) {
+	c := &CloudWatch{
+		Regions:   []string{"eu-north-1", "eu-west-3"},
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 10,
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{
+		"eu-north-1": &mockNoDatapointsCloudWatchClient{},
+		"eu-west-3":  &mockGatherCloudWatchClient{},
+	}
+
+	// the count is registered for every region, not only the region option
+	assert.NoError(t, c.Gather(&acc))
+	assert.Equal(t, int64(1), c.emptyStats["eu-north-1"].Get())
+	assert.Equal(t, int64(0), c.emptyStats["eu-west-3"].Get())
 }
 
-func TestMetricsCacheTimeout(t *testing.T) {
-	ttl, _ := time.ParseDuration("5ms")
-	cache := &MetricCache{
-		Metrics: []*cloudwatch.Metric{},
-		Fetched: time.Now(),
-		TTL:     ttl,
+func TestGatherMultipleRegions(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
 	}
 
-	assert.True(t, cache.IsValid())
-	time.Sleep(ttl)
-	assert.False(t, cache.IsValid())
+	for _, useGetMetricData := range []bool{false, true} {
+		c := &CloudWatch{
+			Region:           "us-east-1",
+			Regions:          []string{"eu-west-1"},
+			Namespace:        "AWS/ELB",
+			Delay:            internalDuration,
+			Period:           internalDuration,
+			RateLimit:        10,
+			Statistics:       []string{"Average"},
+			UseGetMetricData: useGetMetricData,
+		}
+
+		var acc testutil.Accumulator
+		c.clients = map[string]cloudwatchClient{
+			"us-east-1": &mockGatherCloudWatchClient{},
+			"eu-west-1": &mockGatherCloudWatchClient{},
+		}
+
+		assert.NoError(t, c.Gather(&acc))
+
+		assert.Len(t, acc.Metrics, 2)
+		for _, region := range []string{"us-east-1", "eu-west-1"} {
+			tags := map[string]string{}
+			tags["region"] = region
+			tags["load_balancer_name"] = "p-example"
+			if !useGetMetricData {
+				tags["unit"] = "seconds"
+			}
+
+			fields := map[string]interface{}{}
+			fields["latency_average"] = 0.2
+			acc.AssertContainsTaggedFields(t, "cloudwatch_aws_elb", fields, tags)
+		}
+		assert.Len(t, c.metricCache["eu-west-1"], 1)
+	}
+}
+
+func TestRegions(t *testing.T) {
+	c := &CloudWatch{Region: "us-east-1"}
+	assert.Equal(t, []string{"us-east-1"}, c.regions())
+
+	c.Regions = []string{"eu-west-1"}
+	assert.Equal(t, []string{"us-east-1", "eu-west-1"}, c.regions())
+
+	c.Regions = []string{"eu-west-1", "us-east-1"}
+	assert.Equal(t, []string{"eu-west-1", "us-east-1"}, c.regions())
+
+	c.Region = ""
+	assert.Equal(t, []string{"eu-west-1", "us-east-1"}, c.regions())
+}
+
+func TestGatherStatisticOnlyFieldNaming(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:      "us-east-1",
+		Namespace:   "AWS/ELB",
+		Delay:       internalDuration,
+		Period:      internalDuration,
+		RateLimit:   10,
+		Statistics:  []string{"Average", "SampleCount"},
+		FieldNaming: "statistic_only",
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	fields := map[string]interface{}{}
+	fields["average"] = 0.2
+	fields["sample_count"] = 100.0
+
+	tags := map[string]string{}
+	tags["unit"] = "seconds"
+	tags["region"] = "us-east-1"
+	tags["load_balancer_name"] = "p-example"
+	tags["metric_name"] = "latency"
+
+	acc.AssertContainsTaggedFields(t, "cloudwatch_aws_elb", fields, tags)
+}
+
+func TestGatherStatisticLabels(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:          "us-east-1",
+		Namespace:       "AWS/ELB",
+		Delay:           internalDuration,
+		Period:          internalDuration,
+		RateLimit:       10,
+		Statistics:      []string{"Average", "SampleCount", "Sum"},
+		StatisticLabels: map[string]string{"Average": "avg", "SampleCount": "n", "p99": "p99", "rate": "per_second"},
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	// statistics without a label keep their snake cased name
+	fields := map[string]interface{}{}
+	fields["latency_avg"] = 0.2
+	fields["latency_n"] = 100.0
+	fields["latency_sum"] = 123.0
+
+	tags := map[string]string{}
+	tags["unit"] = "seconds"
+	tags["region"] = "us-east-1"
+	tags["load_balancer_name"] = "p-example"
+
+	acc.AssertContainsTaggedFields(t, "cloudwatch_aws_elb", fields, tags)
+
+	c.FieldNaming = "statistic_only"
+	assert.Equal(t, "avg", c.fieldName(&SelectedMetric{Metric: &cloudwatch.Metric{MetricName: aws.String("Latency")}}, "Average"))
+}
+
+func TestGatherPeriodTag(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Delay:     internalDuration,
+		Period:    internalDuration,
+		RateLimit: 10,
+		PeriodTag: true,
+		Metrics: []*Metric{
+			&Metric{
+				MetricNames: []string{"Latency"},
+				Dimensions: []*Dimension{
+					&Dimension{Name: "LoadBalancerName", Value: "p-example"},
+				},
+				Period: internal.Duration{Duration: 5 * time.Minute},
+			},
+		},
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	tags := map[string]string{}
+	tags["unit"] = "seconds"
+	tags["region"] = "us-east-1"
+	tags["load_balancer_name"] = "p-example"
+	tags["period"] = "300"
+
+	assert.Equal(t, tags, acc.Metrics[0].Tags)
+}
+
+func TestGatherNoRegionTag(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:        "us-east-1",
+		Namespace:     "AWS/ELB",
+		Delay:         internalDuration,
+		Period:        internalDuration,
+		RateLimit:     10,
+		OmitRegionTag: true,
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	_, ok := acc.Metrics[0].Tags["region"]
+	assert.False(t, ok)
+}
+
+func TestGatherEmitRate(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+
+	for _, useGetMetricData := range []bool{false, true} {
+		c := &CloudWatch{
+			Region:           "us-east-1",
+			Namespace:        "AWS/ELB",
+			Delay:            internalDuration,
+			Period:           internalDuration,
+			RateLimit:        10,
+			EmitRate:         true,
+			UseGetMetricData: useGetMetricData,
+			Statistics:       []string{"Sum", "Average"},
+		}
+
+		var acc testutil.Accumulator
+		c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+		assert.NoError(t, c.Gather(&acc))
+
+		fields := map[string]interface{}{}
+		fields["latency_sum"] = 123.0
+		fields["latency_average"] = 0.2
+		fields["latency_rate"] = 2.05
+
+		assert.Equal(t, fields, acc.Metrics[0].Fields)
+	}
+}
+
+func TestGatherStatisticAsTag(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:         "us-east-1",
+		Namespace:      "AWS/ELB",
+		Delay:          internalDuration,
+		Period:         internalDuration,
+		RateLimit:      10,
+		EmitRate:       true,
+		StatisticAsTag: true,
+		Statistics:     []string{"Sum", "Average"},
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+	assert.NoError(t, c.Gather(&acc))
+	assert.Len(t, acc.Metrics, 3)
+
+	values := map[string]interface{}{}
+	for _, m := range acc.Metrics {
+		assert.Equal(t, "latency", m.Tags["metric_name"])
+		assert.Len(t, m.Fields, 1)
+		values[m.Tags["statistic"]] = m.Fields["value"]
+	}
+	assert.Equal(t, map[string]interface{}{"sum": 123.0, "average": 0.2, "rate": 2.05}, values)
+}
+
+func TestGatherTimestampField(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+
+	for _, useGetMetricData := range []bool{false, true} {
+		c := &CloudWatch{
+			Region:           "us-east-1",
+			Namespace:        "AWS/ELB",
+			Delay:            internalDuration,
+			Period:           internalDuration,
+			RateLimit:        10,
+			TimestampField:   true,
+			UseGetMetricData: useGetMetricData,
+			Statistics:       []string{"Sum"},
+		}
+
+		var acc testutil.Accumulator
+		c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+		assert.NoError(t, c.Gather(&acc))
+
+		m := acc.Metrics[0]
+		assert.Equal(t, m.Time.UnixNano()/int64(time.Millisecond), m.Fields["cloudwatch_timestamp"])
+	}
+}
+
+func TestGatherCountAsInt(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+
+	for _, useGetMetricData := range []bool{false, true} {
+		c := &CloudWatch{
+			Region:           "us-east-1",
+			Namespace:        "AWS/ELB",
+			Delay:            internalDuration,
+			Period:           internalDuration,
+			RateLimit:        10,
+			CountAsInt:       true,
+			UseGetMetricData: useGetMetricData,
+			Statistics:       []string{"Sum", "SampleCount"},
+		}
+
+		var acc testutil.Accumulator
+		c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+		assert.NoError(t, c.Gather(&acc))
+
+		// the sum of seconds is not a count
+		fields := map[string]interface{}{}
+		fields["latency_sum"] = 123.0
+		fields["latency_sample_count"] = int64(100)
+
+		assert.Equal(t, fields, acc.Metrics[0].Fields)
+	}
+}
+
+func TestFieldValue(t *testing.T) {
+	c := &CloudWatch{CountAsInt: true}
+	assert.Equal(t, int64(42), c.fieldValue("Sum", "Count", 42))
+	assert.Equal(t, 42.0, c.fieldValue("Sum", "Bytes", 42))
+	assert.Equal(t, 42.0, c.fieldValue("Average", "Count", 42))
+	assert.Equal(t, int64(42), c.fieldValue("SampleCount", "", 42))
+
+	c.CountAsInt = false
+	assert.Equal(t, 42.0, c.fieldValue("SampleCount", "Count", 42))
+}
+
+type mockLabelCloudWatchClient struct {
+	mockGatherCloudWatchClient
+	labels []*string
+}
+
+func (m *mockLabelCloudWatchClient) GetMetricDataWithContext(ctx aws.Context, params *cloudwatch.GetMetricDataInput, opts ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	result, err := m.mockGatherCloudWatchClient.GetMetricDataWithContext(ctx, params, opts...)
+	for i, q := range params.MetricDataQueries {
+		m.labels = append(m.labels, q.Label)
+		result.MetricDataResults[i].Label = aws.String("Latency p-example")
+	}
+	return result, err
+}
+
+func TestGatherLabelTemplate(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+
+	for _, useGetMetricData := range []bool{false, true} {
+		c := &CloudWatch{
+			Region:           "us-east-1",
+			Namespace:        "AWS/ELB",
+			Delay:            internalDuration,
+			Period:           internalDuration,
+			RateLimit:        10,
+			UseGetMetricData: useGetMetricData,
+			LabelTemplate:    "${PROP('MetricName')} ${PROP('Dim.LoadBalancerName')}",
+		}
+
+		var acc testutil.Accumulator
+		client := &mockLabelCloudWatchClient{}
+		c.clients = map[string]cloudwatchClient{c.Region: client}
+
+		assert.NoError(t, c.Gather(&acc))
+		assert.Equal(t, "Latency p-example", acc.Metrics[0].Tags["metric_label"])
+
+		// the template is resolved by CloudWatch with GetMetricData
+		for _, label := range client.labels {
+			assert.Equal(t, c.LabelTemplate, *label)
+		}
+	}
+}
+
+func TestExpandLabel(t *testing.T) {
+	metric := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			Namespace:  aws.String("AWS/EC2"),
+			MetricName: aws.String("CPUUtilization"),
+			Dimensions: []*cloudwatch.Dimension{
+				&cloudwatch.Dimension{
+					Name:  aws.String("InstanceId"),
+					Value: aws.String("i-1"),
+				},
+			},
+		},
+		Region: "us-east-1",
+	}
+
+	c := &CloudWatch{
+		Period:        internal.Duration{Duration: 5 * time.Minute},
+		LabelTemplate: "${PROP('Namespace')}/${PROP('MetricName')} ${PROP('Dim.InstanceId')} ${PROP('Region')} ${PROP('Period')}",
+	}
+	assert.Equal(t, "AWS/EC2/CPUUtilization i-1 us-east-1 300", c.expandLabel(metric))
+
+	// unknown placeholders are kept
+	c.LabelTemplate = "${PROP('Dim.VolumeId')} ${AVG}"
+	assert.Equal(t, "${PROP('Dim.VolumeId')} ${AVG}", c.expandLabel(metric))
+}
+
+type mockLinkedAccountsCloudWatchClient struct {
+	mockGatherCloudWatchClient
+	mu       sync.Mutex
+	linked   bool
+	accounts []string
+}
+
+func (m *mockLinkedAccountsCloudWatchClient) ListMetricsWithContext(ctx aws.Context, params *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
+	m.linked = aws.BoolValue(params.IncludeLinkedAccounts)
+	result, err := m.mockGatherCloudWatchClient.ListMetricsWithContext(ctx, params, opts...)
+
+	// the same metric in two source accounts
+	result.Metrics = append(result.Metrics, result.Metrics[0])
+	result.OwningAccounts = aws.StringSlice([]string{"111111111111", "222222222222"})
+	return result, err
+}
+
+func (m *mockLinkedAccountsCloudWatchClient) GetMetricDataWithContext(ctx aws.Context, params *cloudwatch.GetMetricDataInput, opts ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	m.mu.Lock()
+	for _, q := range params.MetricDataQueries {
+		m.accounts = append(m.accounts, aws.StringValue(q.AccountId))
+	}
+	m.mu.Unlock()
+	return m.mockGatherCloudWatchClient.GetMetricDataWithContext(ctx, params, opts...)
+}
+
+func TestGatherLinkedAccounts(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:           "us-east-1",
+		Namespace:        "AWS/ELB",
+		Delay:            internalDuration,
+		Period:           internalDuration,
+		RateLimit:        10,
+		UseGetMetricData: true,
+		LinkedAccounts:   true,
+		Statistics:       []string{"Sum"},
+	}
+
+	var acc testutil.Accumulator
+	client := &mockLinkedAccountsCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: client}
+
+	assert.NoError(t, c.Gather(&acc))
+	assert.True(t, client.linked)
+	sort.Strings(client.accounts)
+	assert.Equal(t, []string{"111111111111", "222222222222"}, client.accounts)
+
+	accounts := []string{}
+	for _, m := range acc.Metrics {
+		accounts = append(accounts, m.Tags["account_id"])
+	}
+	sort.Strings(accounts)
+	assert.Equal(t, []string{"111111111111", "222222222222"}, accounts)
+
+	// a filter selects the metrics of a single source account
+	c = &CloudWatch{
+		Region:           "us-east-1",
+		Namespace:        "AWS/ELB",
+		Delay:            internalDuration,
+		Period:           internalDuration,
+		RateLimit:        10,
+		UseGetMetricData: true,
+		LinkedAccounts:   true,
+		Statistics:       []string{"Sum"},
+		Metrics: []*Metric{
+			&Metric{
+				MetricNames: []string{"*"},
+				AccountID:   "222222222222",
+				Dimensions:  []*Dimension{&Dimension{Name: "LoadBalancerName", Value: "*"}},
+			},
+		},
+	}
+
+	acc = testutil.Accumulator{}
+	client = &mockLinkedAccountsCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: client}
+
+	assert.NoError(t, c.Gather(&acc))
+	assert.Equal(t, []string{"222222222222"}, client.accounts)
+	assert.Len(t, acc.Metrics, 1)
+	assert.Equal(t, "222222222222", acc.Metrics[0].Tags["account_id"])
+}
+
+func TestSetFieldCollision(t *testing.T) {
+	fields := map[string]interface{}{}
+	setField(fields, formatField("HTTPCode_Backend", "sum"), 1.0)
+	setField(fields, formatField("HTTP_Code_Backend", "sum"), 2.0)
+
+	assert.Equal(t, map[string]interface{}{"http_code_backend_sum": 1.0}, fields)
+}
+
+func TestNewDatapoints(t *testing.T) {
+	c := &CloudWatch{OnlyNewDatapoints: true}
+	metric := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			Namespace:  aws.String("AWS/ELB"),
+			MetricName: aws.String("Latency"),
+		},
+	}
+
+	now := time.Now().Truncate(time.Minute)
+	datapoint := func(ts time.Time) *cloudwatch.Datapoint {
+		return &cloudwatch.Datapoint{Timestamp: aws.Time(ts), Sum: aws.Float64(1)}
+	}
+
+	first := c.newDatapoints(metric, []*cloudwatch.Datapoint{
+		datapoint(now.Add(-2 * time.Minute)),
+		datapoint(now.Add(-time.Minute)),
+	})
+	assert.Len(t, first, 2)
+
+	// datapoints of overlapping windows are only emitted once
+	second := c.newDatapoints(metric, []*cloudwatch.Datapoint{
+		datapoint(now.Add(-time.Minute)),
+		datapoint(now),
+	})
+	assert.Equal(t, []*cloudwatch.Datapoint{datapoint(now)}, second)
+
+	// and the last timestamp is kept when no datapoint is newer
+	assert.Len(t, c.newDatapoints(metric, nil), 0)
+	assert.Len(t, c.newDatapoints(metric, []*cloudwatch.Datapoint{datapoint(now)}), 0)
+}
+
+func TestGatherTagRename(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+
+	for _, from := range []string{"LoadBalancerName", "load_balancer_name"} {
+		c := &CloudWatch{
+			Region:     "us-east-1",
+			Namespace:  "AWS/ELB",
+			Delay:      internalDuration,
+			Period:     internalDuration,
+			RateLimit:  10,
+			TagRenames: []*TagRename{&TagRename{From: from, To: "lb"}},
+		}
+
+		var acc testutil.Accumulator
+		c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+		assert.NoError(t, c.Gather(&acc))
+
+		tags := map[string]string{}
+		tags["unit"] = "seconds"
+		tags["region"] = "us-east-1"
+		tags["lb"] = "p-example"
+
+		assert.Equal(t, tags, acc.Metrics[0].Tags, from)
+	}
+}
+
+type mockUnitNoneCloudWatchClient struct {
+	mockGatherCloudWatchClient
+}
+
+func (m *mockUnitNoneCloudWatchClient) GetMetricStatisticsWithContext(ctx aws.Context, params *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	result, err := m.mockGatherCloudWatchClient.GetMetricStatisticsWithContext(ctx, params, opts...)
+	result.Datapoints[0].Unit = aws.String("None")
+	return result, err
+}
+
+func TestGatherOmitUnitNone(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+
+	for _, omit := range []bool{false, true} {
+		c := &CloudWatch{
+			Region:       "us-east-1",
+			Namespace:    "AWS/ELB",
+			Delay:        internalDuration,
+			Period:       internalDuration,
+			RateLimit:    10,
+			OmitUnitNone: omit,
+		}
+
+		var acc testutil.Accumulator
+		c.clients = map[string]cloudwatchClient{c.Region: &mockUnitNoneCloudWatchClient{}}
+
+		assert.NoError(t, c.Gather(&acc))
+
+		unit, ok := acc.Metrics[0].Tags["unit"]
+		if omit {
+			assert.False(t, ok)
+		} else {
+			assert.Equal(t, "none", unit)
+		}
+	}
+}
+
+func TestGatherUnitLabels(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:     "us-east-1",
+		Namespace:  "AWS/ELB",
+		Delay:      internalDuration,
+		Period:     internalDuration,
+		RateLimit:  10,
+		UnitLabels: map[string]string{"Seconds": "s"},
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+	assert.NoError(t, c.Gather(&acc))
+	assert.Equal(t, "s", acc.Metrics[0].Tags["unit"])
+
+	// units without a label keep their snake cased name
+	assert.Equal(t, "count/_second", c.unitTag("Count/Second"))
+}
+
+func TestMeasurementName(t *testing.T) {
+	metric := &SelectedMetric{
+		Metric: &cloudwatch.Metric{Namespace: aws.String("AWS/ELB")},
+	}
+
+	c := &CloudWatch{}
+	assert.Equal(t, "cloudwatch_aws_elb", c.measurementName(metric))
+
+	c.MeasurementPrefix = "aws_"
+	assert.Equal(t, "aws_aws_elb", c.measurementName(metric))
+
+	c.Measurement = "aws_metrics"
+	assert.Equal(t, "aws_metrics", c.measurementName(metric))
+
+	// the measurement of a metric filter overrides the others
+	metric.Filter = &Metric{Measurement: "latency"}
+	assert.Equal(t, "latency", c.measurementName(metric))
+}
+
+func TestFormatNamespace(t *testing.T) {
+	tests := map[string]string{
+		"AWS/ELB":             "aws_elb",
+		"AWS/ApplicationELB":  "aws_application_elb",
+		"My App/Prod":         "my_app_prod",
+		"Custom:Orders/Queue": "custom_orders_queue",
+		"/Custom  Metrics/":   "custom_metrics",
+		"Acme_/_Billing":      "acme_billing",
+	}
+
+	for namespace, expected := range tests {
+		assert.Equal(t, expected, formatNamespace(namespace), namespace)
+	}
+
+	assert.Equal(t, "cloudwatch_my_app_prod", formatMeasurement("My App/Prod"))
+}
+
+func TestGatherMetricData(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:           "us-east-1",
+		Namespace:        "AWS/ELB",
+		Delay:            internalDuration,
+		Period:           internalDuration,
+		RateLimit:        10,
+		UseGetMetricData: true,
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	fields := map[string]interface{}{}
+	fields["latency_minimum"] = 0.1
+	fields["latency_maximum"] = 0.3
+	fields["latency_average"] = 0.2
+	fields["latency_sum"] = 123.0
+	fields["latency_sample_count"] = 100.0
+
+	tags := map[string]string{}
+	tags["region"] = "us-east-1"
+	tags["load_balancer_name"] = "p-example"
+
+	assert.Equal(t, 1, len(acc.Metrics))
+	acc.AssertContainsTaggedFields(t, "cloudwatch_aws_elb", fields, tags)
+}
+
+type mockPagedMetricDataCloudWatchClient struct {
+	mockGatherCloudWatchClient
+	calls int
+}
+
+func (m *mockPagedMetricDataCloudWatchClient) GetMetricDataWithContext(ctx aws.Context, params *cloudwatch.GetMetricDataInput, opts ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	m.calls++
+	result := &cloudwatch.GetMetricDataOutput{}
+	// return the first query in a page of its own
+	if params.NextToken == nil {
+		result.NextToken = aws.String("next")
+		result.MetricDataResults = []*cloudwatch.MetricDataResult{
+			&cloudwatch.MetricDataResult{
+				Id:         params.MetricDataQueries[0].Id,
+				Timestamps: []*time.Time{params.EndTime},
+				Values:     []*float64{aws.Float64(1)},
+			},
+		}
+		return result, nil
+	}
+	for _, q := range params.MetricDataQueries[1:] {
+		result.MetricDataResults = append(result.MetricDataResults, &cloudwatch.MetricDataResult{
+			Id:         q.Id,
+			Timestamps: []*time.Time{params.EndTime},
+			Values:     []*float64{aws.Float64(1)},
+		})
+	}
+	return result, nil
+}
+
+func TestGatherMetricDataPagination(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:           "us-east-1",
+		Namespace:        "AWS/ELB",
+		Delay:            internalDuration,
+		Period:           internalDuration,
+		RateLimit:        10,
+		UseGetMetricData: true,
+	}
+
+	var acc testutil.Accumulator
+	client := &mockPagedMetricDataCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: client}
+
+	assert.NoError(t, c.Gather(&acc))
+	assert.Equal(t, 2, client.calls)
+	assert.Equal(t, 1, len(acc.Metrics))
+	assert.Equal(t, 5, len(acc.Metrics[0].Fields))
+}
+
+func TestGatherMetricDataBatchRateLimit(t *testing.T) {
+	c := &CloudWatch{
+		Region: "us-east-1",
+		Delay:  internal.Duration{Duration: time.Minute},
+		Period: internal.Duration{Duration: time.Minute},
+	}
+	c.clients = map[string]cloudwatchClient{c.Region: &mockPagedMetricDataCloudWatchClient{}}
+
+	metrics := []*SelectedMetric{}
+	for i := 0; i < 50; i++ {
+		metrics = append(metrics, &SelectedMetric{
+			Metric: &cloudwatch.Metric{
+				Namespace:  aws.String("AWS/ELB"),
+				MetricName: aws.String("Latency"),
+			},
+			Region: c.Region,
+		})
+	}
+	batches := c.getMetricDataBatches(metrics, time.Now())
+	assert.Len(t, batches, 1)
+
+	var acc testutil.Accumulator
+	tokens := make(chan bool, 3)
+	for i := 0; i < cap(tokens); i++ {
+		tokens <- true
+	}
+	errChan := make(chan error, 1)
+	c.gatherMetricDataBatch(&acc, batches[0], tokens, errChan)
+	assert.NoError(t, <-errChan)
+
+	// a token is used by each of the 2 pages, whatever the number of metrics
+	assert.Len(t, tokens, 1)
+}
+
+type mockPagedListMetricsCloudWatchClient struct {
+	mockGatherCloudWatchClient
+}
+
+func (m *mockPagedListMetricsCloudWatchClient) ListMetricsWithContext(ctx aws.Context, params *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
+	result, err := m.mockGatherCloudWatchClient.ListMetricsWithContext(ctx, params, opts...)
+	if params.NextToken == nil {
+		result.NextToken = aws.String("next")
+	}
+	return result, err
+}
+
+func TestFetchMetricsRateLimit(t *testing.T) {
+	c := &CloudWatch{
+		Region:   "us-east-1",
+		CacheTTL: internal.Duration{Duration: time.Hour},
+	}
+	c.clients = map[string]cloudwatchClient{c.Region: &mockPagedListMetricsCloudWatchClient{}}
+
+	tokens := make(chan bool, 3)
+	for i := 0; i < cap(tokens); i++ {
+		tokens <- true
+	}
+	metrics, _, err := c.fetchMetrics(c.Region, "AWS/ELB", nil, tokens)
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 2)
+
+	// a token is used by each of the 2 pages
+	assert.Len(t, tokens, 1)
+
+	// but none by the cached listing
+	_, _, err = c.fetchMetrics(c.Region, "AWS/ELB", nil, tokens)
+	assert.NoError(t, err)
+	assert.Len(t, tokens, 1)
+}
+
+type mockAnomalyBandCloudWatchClient struct {
+	mockGatherCloudWatchClient
+	expressions []string
+}
+
+func (m *mockAnomalyBandCloudWatchClient) GetMetricDataWithContext(ctx aws.Context, params *cloudwatch.GetMetricDataInput, opts ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	result := &cloudwatch.GetMetricDataOutput{}
+	for _, q := range params.MetricDataQueries {
+		if q.Expression == nil {
+			result.MetricDataResults = append(result.MetricDataResults, &cloudwatch.MetricDataResult{
+				Id:         q.Id,
+				Timestamps: []*time.Time{params.EndTime},
+				Values:     []*float64{aws.Float64(0.2)},
+			})
+			continue
+		}
+
+		// a band is returned as two time series of the same id, lower first
+		m.expressions = append(m.expressions, *q.Expression)
+		for _, value := range []float64{0.1, 0.4} {
+			result.MetricDataResults = append(result.MetricDataResults, &cloudwatch.MetricDataResult{
+				Id:         q.Id,
+				Timestamps: []*time.Time{params.EndTime},
+				Values:     []*float64{aws.Float64(value)},
+			})
+		}
+	}
+	return result, nil
+}
+
+func TestGatherAnomalyBand(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:           "us-east-1",
+		Namespace:        "AWS/ELB",
+		Delay:            internalDuration,
+		Period:           internalDuration,
+		RateLimit:        10,
+		UseGetMetricData: true,
+		Statistics:       []string{"Average"},
+		Metrics: []*Metric{
+			&Metric{MetricNames: []string{"Latency"}, AnomalyBand: 2.5},
+		},
+	}
+
+	var acc testutil.Accumulator
+	client := &mockAnomalyBandCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: client}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	// the band is computed from the query of the statistic
+	assert.Len(t, client.expressions, 1)
+	assert.Regexp(t, `^ANOMALY_DETECTION_BAND\(m[0-9]+, 2.5\)$`, client.expressions[0])
+
+	fields := map[string]interface{}{}
+	fields["latency_average"] = 0.2
+	fields["latency_average_band_upper"] = 0.4
+	fields["latency_average_band_lower"] = 0.1
+
+	assert.Len(t, acc.Metrics, 1)
+	assert.Equal(t, fields, acc.Metrics[0].Fields)
+}
+
+func TestGetMetricDataQueries(t *testing.T) {
+	c := &CloudWatch{}
+
+	metrics := []*SelectedMetric{}
+	for i := 0; i < 150; i++ {
+		metrics = append(metrics, &SelectedMetric{
+			Metric: &cloudwatch.Metric{
+				Namespace:  aws.String("AWS/ELB"),
+				MetricName: aws.String("Latency"),
+			},
+		})
+	}
+
+	// 150 metrics with 5 statistics each need 2 requests
+	batches := c.getMetricDataBatches(metrics, time.Now())
+	assert.Len(t, batches, 2)
+	assert.Len(t, batches[0].queries, 500)
+	assert.Len(t, batches[1].queries, 250)
+}
+
+func TestGetMetricDataQueriesPeriodOverride(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	c := &CloudWatch{
+		Delay:  internal.Duration{Duration: duration},
+		Period: internal.Duration{Duration: duration},
+	}
+
+	filter := &Metric{Period: internal.Duration{Duration: 6 * time.Hour}}
+	metrics := []*SelectedMetric{
+		&SelectedMetric{Metric: &cloudwatch.Metric{MetricName: aws.String("Latency")}},
+		&SelectedMetric{Metric: &cloudwatch.Metric{MetricName: aws.String("EstimatedCharges")}, Filter: filter},
+	}
+
+	// metrics with different timeframes can't share a request
+	now := time.Now()
+	batches := c.getMetricDataBatches(metrics, now)
+	assert.Len(t, batches, 2)
+	assert.Equal(t, now.Add(-duration).Add(-6*time.Hour), batches[1].start)
+}
+
+type mockSelectMetricsCloudWatchClient struct{}
+
+func (m *mockSelectMetricsCloudWatchClient) ListMetricsWithContext(ctx aws.Context, params *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
+	metrics := []*cloudwatch.Metric{}
+	// 4 metrics are available
+	metricNames := []string{"Latency", "RequestCount", "HealthyHostCount", "UnHealthyHostCount"}
+	// for 3 ELBs
+	loadBalancers := []string{"lb-1", "lb-2", "lb-3"}
+	// in 2 AZs
+	availabilityZones := []string{"us-east-1a", "us-east-1b"}
+	for _, m := range metricNames {
+		for _, lb := range loadBalancers {
+			// For each metric/ELB pair, we get an aggregate value across all AZs.
+			metrics = append(metrics, &cloudwatch.Metric{
+				Namespace:  aws.String("AWS/ELB"),
+				MetricName: aws.String(m),
+				Dimensions: []*cloudwatch.Dimension{
+					&cloudwatch.Dimension{
+						Name:  aws.String("LoadBalancerName"),
+						Value: aws.String(lb),
+					},
+				},
+			})
+			for _, az := range availabilityZones {
+				// We get a metric for each metric/ELB/AZ triplet.
+				metrics = append(metrics, &cloudwatch.Metric{
+					Namespace:  aws.String("AWS/ELB"),
+					MetricName: aws.String(m),
+					Dimensions: []*cloudwatch.Dimension{
+						&cloudwatch.Dimension{
+							Name:  aws.String("LoadBalancerName"),
+							Value: aws.String(lb),
+						},
+						&cloudwatch.Dimension{
+							Name:  aws.String("AvailabilityZone"),
+							Value: aws.String(az),
+						},
+					},
+				})
+			}
+		}
+	}
+
+	result := &cloudwatch.ListMetricsOutput{
+		Metrics: metrics,
+	}
+	return result, nil
+}
+
+func (m *mockSelectMetricsCloudWatchClient) GetMetricStatisticsWithContext(ctx aws.Context, params *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	return nil, nil
+}
+
+func (m *mockSelectMetricsCloudWatchClient) GetMetricDataWithContext(ctx aws.Context, params *cloudwatch.GetMetricDataInput, opts ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	return nil, nil
+}
+
+func TestSelectMetrics(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Delay:     internalDuration,
+		Period:    internalDuration,
+		RateLimit: 10,
+		Metrics: []*Metric{
+			&Metric{
+				MetricNames: []string{"Latency", "RequestCount"},
+				Dimensions: []*Dimension{
+					&Dimension{
+						Name:  "LoadBalancerName",
+						Value: "*",
+					},
+					&Dimension{
+						Name:  "AvailabilityZone",
+						Value: "*",
+					},
+				},
+			},
+		},
+	}
+	c.clients = map[string]cloudwatchClient{c.Region: &mockSelectMetricsCloudWatchClient{}}
+	metrics, err := SelectMetrics(c)
+	// We've asked for 2 (out of 4) metrics, over all 3 load balancers in all 2
+	// AZs. We should get 12 metrics.
+	assert.Equal(t, 12, len(metrics))
+	assert.Nil(t, err)
+}
+
+func TestGatherNoStdout(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Delay:     internalDuration,
+		Period:    internalDuration,
+		RateLimit: 10,
+		Metrics: []*Metric{
+			&Metric{
+				MetricNames: []string{"Latency"},
+				Dimensions: []*Dimension{
+					&Dimension{
+						Name:  "LoadBalancerName",
+						Value: "p-example",
+					},
+				},
+			},
+		},
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	err = c.Gather(&acc)
+	os.Stdout = stdout
+	w.Close()
+	assert.NoError(t, err)
+
+	// the explicitly configured metrics are gathered without printing anything
+	out, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Empty(t, string(out))
+	assert.Len(t, acc.Metrics, 1)
+}
+
+func TestListMetrics(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 10,
+		Metrics: []*Metric{
+			&Metric{
+				MetricNames: []string{"Latency"},
+				Dimensions: []*Dimension{
+					&Dimension{
+						Name:  "LoadBalancerName",
+						Value: "p-example",
+					},
+					&Dimension{
+						Name:  "AvailabilityZone",
+						Value: "us-east-1a",
+					},
+				},
+			},
+		},
+	}
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+	var buf bytes.Buffer
+	assert.NoError(t, c.ListMetrics(&buf))
+	assert.Equal(t, "us-east-1 AWS/ELB Latency LoadBalancerName=p-example,AvailabilityZone=us-east-1a\n", buf.String())
+}
+
+func TestGatherDryRun(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 10,
+		DryRun:    true,
+	}
+
+	var acc testutil.Accumulator
+	client := &mockBackfillCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: client}
+
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	err = c.Gather(&acc)
+	os.Stdout = stdout
+	w.Close()
+	assert.NoError(t, err)
+
+	// the selected metrics are listed without requesting their statistics
+	out, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "us-east-1 AWS/ELB Latency LoadBalancerName=p-example\n", string(out))
+	assert.Empty(t, client.inputs)
+	assert.Empty(t, acc.Metrics)
+}
+
+func TestGatherMetricLabel(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Delay:     internalDuration,
+		Period:    internalDuration,
+		RateLimit: 10,
+		Metrics: []*Metric{
+			&Metric{
+				MetricNames: []string{"Latency"},
+				Label:       "public-lbs",
+				Dimensions: []*Dimension{
+					&Dimension{
+						Name:  "LoadBalancerName",
+						Value: "p-example",
+					},
+				},
+			},
+		},
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	tags := map[string]string{}
+	tags["unit"] = "seconds"
+	tags["region"] = "us-east-1"
+	tags["load_balancer_name"] = "p-example"
+	tags["label"] = "public-lbs"
+
+	assert.Equal(t, tags, acc.Metrics[0].Tags)
+}
+
+func TestSelectMetricsDimensionGlob(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 10,
+		Metrics: []*Metric{
+			&Metric{
+				MetricNames: []string{"Latency"},
+				Dimensions: []*Dimension{
+					&Dimension{
+						Name:  "LoadBalancerName",
+						Value: "lb-[12]",
+					},
+					&Dimension{
+						Name:  "AvailabilityZone",
+						Value: "us-east-1?",
+					},
+				},
+			},
+		},
+	}
+	assert.NoError(t, c.Init())
+	c.clients = map[string]cloudwatchClient{c.Region: &mockSelectMetricsCloudWatchClient{}}
+	metrics, err := SelectMetrics(c)
+	// 2 load balancers match in 2 AZs
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(metrics))
+}
+
+type mockListFiltersCloudWatchClient struct {
+	mockSelectMetricsCloudWatchClient
+	filters [][]*cloudwatch.DimensionFilter
+}
+
+func (m *mockListFiltersCloudWatchClient) ListMetricsWithContext(ctx aws.Context, params *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
+	m.filters = append(m.filters, params.Dimensions)
+	return m.mockSelectMetricsCloudWatchClient.ListMetricsWithContext(ctx, params, opts...)
+}
+
+func TestSelectMetricsListDimensionFilters(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		CacheTTL:  internal.Duration{Duration: time.Hour},
+		RateLimit: 10,
+		Metrics: []*Metric{
+			&Metric{
+				MetricNames: []string{"Latency"},
+				Dimensions: []*Dimension{
+					&Dimension{Name: "LoadBalancerName", Value: "lb-1"},
+					&Dimension{Name: "AvailabilityZone", Value: "*"},
+				},
+			},
+		},
+	}
+	assert.NoError(t, c.Init())
+	client := &mockListFiltersCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: client}
+
+	metrics, err := SelectMetrics(c)
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 2)
+
+	// the listing is narrowed to the exact dimension values and the names of
+	// the wildcard dimensions, and cached as such
+	filters := []*cloudwatch.DimensionFilter{
+		&cloudwatch.DimensionFilter{Name: aws.String("LoadBalancerName"), Value: aws.String("lb-1")},
+		&cloudwatch.DimensionFilter{Name: aws.String("AvailabilityZone")},
+	}
+	assert.Equal(t, [][]*cloudwatch.DimensionFilter{filters}, client.filters)
+	assert.NotNil(t, c.metricCache["us-east-1"]["AWS/ELB/AvailabilityZone,LoadBalancerName=lb-1"])
+}
+
+type mockRecentlyActiveCloudWatchClient struct {
+	mockSelectMetricsCloudWatchClient
+	recentlyActive []*string
+}
+
+func (m *mockRecentlyActiveCloudWatchClient) ListMetricsWithContext(ctx aws.Context, params *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
+	m.recentlyActive = append(m.recentlyActive, params.RecentlyActive)
+	return m.mockSelectMetricsCloudWatchClient.ListMetricsWithContext(ctx, params, opts...)
+}
+
+func TestSelectMetricsRecentlyActive(t *testing.T) {
+	for _, recentlyActive := range []bool{false, true} {
+		c := &CloudWatch{
+			Region:         "us-east-1",
+			Namespace:      "AWS/ELB",
+			Period:         internal.Duration{Duration: time.Minute},
+			RateLimit:      10,
+			RecentlyActive: recentlyActive,
+		}
+		assert.NoError(t, c.Init())
+		client := &mockRecentlyActiveCloudWatchClient{}
+		c.clients = map[string]cloudwatchClient{c.Region: client}
+
+		_, err := SelectMetrics(c)
+		assert.NoError(t, err)
+		assert.Len(t, client.recentlyActive, 1)
+		if recentlyActive {
+			assert.Equal(t, "PT3H", aws.StringValue(client.recentlyActive[0]))
+		} else {
+			assert.Nil(t, client.recentlyActive[0])
+		}
+	}
+}
+
+func TestSelectMetricsDimensionName(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 10,
+		Metrics: []*Metric{
+			&Metric{
+				MetricNames: []string{"Latency"},
+				Dimensions: []*Dimension{
+					&Dimension{Name: "LoadBalancerName"},
+				},
+			},
+		},
+	}
+	assert.NoError(t, c.Init())
+	c.clients = map[string]cloudwatchClient{c.Region: &mockSelectMetricsCloudWatchClient{}}
+	metrics, err := SelectMetrics(c)
+	// 3 load balancers, both aggregated and in 2 AZs
+	assert.Nil(t, err)
+	assert.Equal(t, 9, len(metrics))
+
+	// a value still requires the exact dimensions
+	c.Metrics[0].Dimensions[0].Value = "*"
+	metrics, err = SelectMetrics(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(metrics))
+
+	// as do strict dimensions
+	c.Metrics[0].Dimensions[0].Value = ""
+	c.StrictDims = true
+	metrics, err = SelectMetrics(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(metrics))
+	for _, metric := range metrics {
+		assert.Len(t, metric.Dimensions, 1)
+	}
+}
+
+func TestSelectMetricsNameWildcard(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 10,
+		Metrics: []*Metric{
+			&Metric{
+				MetricNames: []string{"*"},
+				Dimensions: []*Dimension{
+					&Dimension{Name: "LoadBalancerName", Value: "lb-1"},
+					&Dimension{Name: "AvailabilityZone", Value: "*"},
+				},
+			},
+		},
+	}
+	assert.NoError(t, c.Init())
+	c.clients = map[string]cloudwatchClient{c.Region: &mockSelectMetricsCloudWatchClient{}}
+	metrics, err := SelectMetrics(c)
+	// all 4 metrics of the load balancer in 2 AZs
+	assert.Nil(t, err)
+	assert.Equal(t, 8, len(metrics))
+
+	names := map[string]bool{}
+	for _, metric := range metrics {
+		names[*metric.MetricName] = true
+	}
+	assert.Len(t, names, 4)
+}
+
+func TestSelectMetricsDimensionSets(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 10,
+		Metrics: []*Metric{
+			&Metric{
+				MetricNames: []string{"Latency"},
+				Dimensions: []*Dimension{
+					&Dimension{Name: "LoadBalancerName", Value: "lb-1"},
+				},
+				DimensionSets: []*DimensionSet{
+					&DimensionSet{},
+					&DimensionSet{
+						Dimensions: []*Dimension{
+							&Dimension{Name: "AvailabilityZone", Value: "*"},
+						},
+					},
+				},
+			},
+		},
+	}
+	assert.NoError(t, c.Init())
+	assert.Len(t, c.Metrics, 2)
+
+	c.clients = map[string]cloudwatchClient{c.Region: &mockSelectMetricsCloudWatchClient{}}
+	metrics, err := SelectMetrics(c)
+	// the aggregated metric of the load balancer and the one of each AZ
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(metrics))
+	for _, metric := range metrics {
+		assert.Equal(t, "lb-1", *metric.Dimensions[0].Value)
+	}
+}
+
+func TestSelectMetricsExclude(t *testing.T) {
+	c := &CloudWatch{
+		Region:       "us-east-1",
+		Namespace:    "AWS/ELB",
+		Period:       internal.Duration{Duration: time.Minute},
+		RateLimit:    10,
+		ExcludeNames: []string{"*HostCount"},
+		ExcludeDimensions: []*Dimension{
+			&Dimension{Name: "LoadBalancerName", Value: "lb-1"},
+		},
+	}
+	assert.NoError(t, c.Init())
+	c.clients = map[string]cloudwatchClient{c.Region: &mockSelectMetricsCloudWatchClient{}}
+	metrics, err := SelectMetrics(c)
+	// 2 metrics of 2 load balancers, both aggregated and in 2 AZs
+	assert.Nil(t, err)
+	assert.Equal(t, 12, len(metrics))
+
+	// a dimension without value excludes every metric having it
+	c.ExcludeDimensions = append(c.ExcludeDimensions, &Dimension{Name: "AvailabilityZone"})
+	metrics, err = SelectMetrics(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(metrics))
+	for _, metric := range metrics {
+		assert.Len(t, metric.Dimensions, 1)
+		assert.NotEqual(t, "lb-1", *metric.Dimensions[0].Value)
+	}
+}
+
+func TestSelectMetricsShards(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 10,
+	}
+	assert.NoError(t, c.Init())
+	c.clients = map[string]cloudwatchClient{c.Region: &mockSelectMetricsCloudWatchClient{}}
+	all, err := SelectMetrics(c)
+	assert.NoError(t, err)
+
+	// every metric is selected by a single shard
+	c.ShardTotal = 3
+	selected := map[string]int{}
+	for i := 0; i < c.ShardTotal; i++ {
+		c.ShardIndex = i
+		metrics, err := SelectMetrics(c)
+		assert.NoError(t, err)
+		assert.True(t, len(metrics) < len(all))
+		for _, metric := range metrics {
+			selected[metric.key()]++
+		}
+	}
+	assert.Len(t, selected, len(all))
+	for key, n := range selected {
+		assert.Equal(t, 1, n, key)
+	}
+}
+
+func TestMetricShard(t *testing.T) {
+	metric := func(dimensions ...string) *SelectedMetric {
+		m := &SelectedMetric{Metric: &cloudwatch.Metric{
+			Namespace:  aws.String("AWS/ELB"),
+			MetricName: aws.String("Latency"),
+		}}
+		for _, d := range dimensions {
+			m.Dimensions = append(m.Dimensions, &cloudwatch.Dimension{Name: aws.String(d), Value: aws.String("v")})
+		}
+		return m
+	}
+
+	// the shard does not depend on the order of the dimensions
+	for total := 2; total < 10; total++ {
+		assert.Equal(t, metricShard(metric("a", "b"), total), metricShard(metric("b", "a"), total))
+	}
+}
+
+func TestGatherOverlappingFilters(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:     "us-east-1",
+		Namespace:  "AWS/ELB",
+		Delay:      internalDuration,
+		Period:     internalDuration,
+		RateLimit:  10,
+		Statistics: []string{"Average"},
+		Metrics: []*Metric{
+			&Metric{
+				MetricNames: []string{"Latency"},
+				Dimensions: []*Dimension{
+					&Dimension{Name: "LoadBalancerName", Value: "p-example"},
+				},
+			},
+			&Metric{
+				MetricNames: []string{"Latency"},
+				Dimensions: []*Dimension{
+					&Dimension{Name: "LoadBalancerName", Value: "p-*"},
+				},
+			},
+		},
+	}
+
+	var acc testutil.Accumulator
+	client := &mockExtendedStatisticsCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: client}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	// both filters select the same metric, which is only requested once
+	assert.Len(t, client.requests, 1)
+	assert.Len(t, acc.Metrics, 1)
+}
+
+func TestSelectMetricsNamesRegex(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 10,
+		Metrics: []*Metric{
+			&Metric{
+				NamesRegex: []string{"^(Un)?HealthyHostCount$"},
+				Dimensions: []*Dimension{
+					&Dimension{
+						Name:  "LoadBalancerName",
+						Value: "lb-1",
+					},
+				},
+			},
+		},
+	}
+	assert.NoError(t, c.Init())
+	c.clients = map[string]cloudwatchClient{c.Region: &mockSelectMetricsCloudWatchClient{}}
+	metrics, err := SelectMetrics(c)
+	// 2 metrics match the pattern for a single load balancer
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(metrics))
+	for _, m := range metrics {
+		assert.Contains(t, *m.MetricName, "HealthyHostCount")
+	}
+}
+
+func TestInitInvalidNamesRegex(t *testing.T) {
+	c := &CloudWatch{
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 10,
+		Metrics: []*Metric{
+			&Metric{NamesRegex: []string{"("}},
+		},
+	}
+	assert.Error(t, c.Init())
+}
+
+func TestGenerateStatisticsInputParams(t *testing.T) {
+	d := &cloudwatch.Dimension{
+		Name:  aws.String("LoadBalancerName"),
+		Value: aws.String("p-example"),
+	}
+
+	m := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			MetricName: aws.String("Latency"),
+			Dimensions: []*cloudwatch.Dimension{d},
+		},
+	}
+
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Delay:     internalDuration,
+		Period:    internalDuration,
+	}
+
+	c.initializeCloudWatch()
+
+	now := time.Now()
+
+	params := c.getStatisticsInput(m, now)
+
+	assert.EqualValues(t, *params.EndTime, now.Add(-c.Delay.Duration))
+	assert.EqualValues(t, *params.StartTime, now.Add(-c.Period.Duration).Add(-c.Delay.Duration))
+	assert.Len(t, params.Dimensions, 1)
+	assert.Len(t, params.Statistics, 5)
+	assert.EqualValues(t, *params.Period, 60)
+}
+
+func TestGenerateStatisticsInputParamsOverrides(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+
+	m := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			MetricName: aws.String("EstimatedCharges"),
+		},
+		Filter: &Metric{
+			Period: internal.Duration{Duration: 6 * time.Hour},
+			Delay:  internal.Duration{Duration: time.Hour},
+		},
+	}
+
+	c := &CloudWatch{
+		Namespace: "AWS/Billing",
+		Delay:     internalDuration,
+		Period:    internalDuration,
+	}
+
+	now := time.Now()
+	params := c.getStatisticsInput(m, now)
+
+	assert.EqualValues(t, *params.EndTime, now.Add(-time.Hour))
+	assert.EqualValues(t, *params.StartTime, now.Add(-7*time.Hour))
+	assert.EqualValues(t, *params.Period, 6*60*60)
+	assert.Nil(t, params.Unit)
+}
+
+func TestGenerateStatisticsInputParamsNamespaceDelays(t *testing.T) {
+	m := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			Namespace:  aws.String("AWS/Billing"),
+			MetricName: aws.String("EstimatedCharges"),
+		},
+	}
+
+	c := &CloudWatch{
+		Namespaces:      []string{"AWS/Billing", "AWS/EC2"},
+		Delay:           internal.Duration{Duration: time.Minute},
+		Period:          internal.Duration{Duration: time.Minute},
+		RateLimit:       10,
+		NamespaceDelays: map[string]string{"AWS/Billing": "6h"},
+	}
+	assert.NoError(t, c.Init())
+
+	now := time.Now()
+	params := c.getStatisticsInput(m, now)
+	assert.EqualValues(t, now.Add(-6*time.Hour), *params.EndTime)
+
+	// namespaces without delay use the plugin delay
+	m.Namespace = aws.String("AWS/EC2")
+	params = c.getStatisticsInput(m, now)
+	assert.EqualValues(t, now.Add(-time.Minute), *params.EndTime)
+
+	// metric filter delays override the namespace delay
+	m.Namespace = aws.String("AWS/Billing")
+	m.Filter = &Metric{Delay: internal.Duration{Duration: time.Hour}}
+	params = c.getStatisticsInput(m, now)
+	assert.EqualValues(t, now.Add(-time.Hour), *params.EndTime)
+}
+
+func TestGenerateStatisticsInputParamsUnit(t *testing.T) {
+	m := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			MetricName: aws.String("NetworkIn"),
+		},
+		Filter: &Metric{Unit: "Bytes"},
+	}
+
+	c := &CloudWatch{
+		Namespace: "AWS/EC2",
+		Period:    internal.Duration{Duration: time.Minute},
+	}
+
+	params := c.getStatisticsInput(m, time.Now())
+	assert.Equal(t, "Bytes", *params.Unit)
+}
+
+func TestGenerateStatisticsInputParamsAlignPeriods(t *testing.T) {
+	m := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			MetricName: aws.String("Latency"),
+		},
+	}
+
+	c := &CloudWatch{
+		Namespace:    "AWS/ELB",
+		Period:       internal.Duration{Duration: 5 * time.Minute},
+		Delay:        internal.Duration{Duration: time.Minute},
+		AlignPeriods: true,
+	}
+
+	// gathers within the same period request the same timeframe
+	now := time.Date(2017, 3, 1, 12, 6, 30, 0, time.UTC)
+	params := c.getStatisticsInput(m, now)
+	later := c.getStatisticsInput(m, now.Add(2*time.Minute))
+	assert.Equal(t, time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC), *params.StartTime)
+	assert.Equal(t, time.Date(2017, 3, 1, 12, 5, 0, 0, time.UTC), *params.EndTime)
+	assert.Equal(t, params.StartTime, later.StartTime)
+	assert.Equal(t, params.EndTime, later.EndTime)
+}
+
+type mockBackfillCloudWatchClient struct {
+	mockGatherCloudWatchClient
+	mu     sync.Mutex
+	inputs []*cloudwatch.GetMetricStatisticsInput
+}
+
+func (m *mockBackfillCloudWatchClient) GetMetricStatisticsWithContext(ctx aws.Context, params *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	m.mu.Lock()
+	m.inputs = append(m.inputs, params)
+	m.mu.Unlock()
+	return &cloudwatch.GetMetricStatisticsOutput{}, nil
+}
+
+func TestGatherBackfill(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		Backfill:  internal.Duration{Duration: 30 * time.Hour},
+		RateLimit: 10,
+	}
+
+	var acc testutil.Accumulator
+	client := &mockBackfillCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: client}
+
+	// 1800 periods are requested in chunks of at most 1440 periods
+	assert.NoError(t, c.Gather(&acc))
+	assert.Len(t, client.inputs, 2)
+	first, last := client.inputs[0], client.inputs[1]
+	assert.Equal(t, 24*time.Hour, first.EndTime.Sub(*first.StartTime))
+	assert.Equal(t, 6*time.Hour, last.EndTime.Sub(*last.StartTime))
+	assert.Equal(t, *first.EndTime, *last.StartTime)
+
+	// following gathers only request the last period
+	client.inputs = nil
+	assert.NoError(t, c.Gather(&acc))
+	assert.Len(t, client.inputs, 1)
+	assert.Equal(t, time.Minute, client.inputs[0].EndTime.Sub(*client.inputs[0].StartTime))
+}
+
+func TestSplitTimeframe(t *testing.T) {
+	end := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	input := &cloudwatch.GetMetricStatisticsInput{
+		StartTime: aws.Time(end.Add(-1440 * time.Minute)),
+		EndTime:   aws.Time(end),
+		Period:    aws.Int64(60),
+	}
+
+	// a timeframe within the limit is requested as is
+	inputs := splitTimeframe(input)
+	assert.Equal(t, []*cloudwatch.GetMetricStatisticsInput{input}, inputs)
+
+	// 2881 periods are split into 3 consecutive requests
+	input.StartTime = aws.Time(end.Add(-2881 * time.Minute))
+	inputs = splitTimeframe(input)
+	assert.Len(t, inputs, 3)
+	assert.Equal(t, *input.StartTime, *inputs[0].StartTime)
+	for i := 1; i < len(inputs); i++ {
+		assert.Equal(t, *inputs[i-1].EndTime, *inputs[i].StartTime)
+	}
+	assert.Equal(t, end, *inputs[2].EndTime)
+	assert.Equal(t, time.Minute, inputs[2].EndTime.Sub(*inputs[2].StartTime))
+
+	// the split requests keep the other parameters
+	assert.Equal(t, int64(60), *inputs[1].Period)
+}
+
+func TestGenerateStatisticsInputParamsStatistics(t *testing.T) {
+	m := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			MetricName: aws.String("Latency"),
+		},
+	}
+
+	c := &CloudWatch{
+		Namespace:  "AWS/ELB",
+		Statistics: []string{"Average", "Sum"},
+	}
+
+	params := c.getStatisticsInput(m, time.Now())
+	assert.Equal(t, []*string{aws.String("Average"), aws.String("Sum")}, params.Statistics)
+
+	// metric filter statistics override the plugin default
+	m.Filter = &Metric{Statistics: []string{"Maximum"}}
+	params = c.getStatisticsInput(m, time.Now())
+	assert.Equal(t, []*string{aws.String("Maximum")}, params.Statistics)
+}
+
+func TestGenerateStatisticsInputParamsNamespaceStatistics(t *testing.T) {
+	m := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			Namespace:  aws.String("AWS/Billing"),
+			MetricName: aws.String("EstimatedCharges"),
+		},
+	}
+
+	c := &CloudWatch{
+		Namespaces: []string{"AWS/Billing", "AWS/EC2"},
+		Statistics: []string{"Average", "Sum"},
+		NamespaceStatistics: map[string][]string{
+			"AWS/Billing": []string{"Sum"},
+		},
+	}
+
+	params := c.getStatisticsInput(m, time.Now())
+	assert.Equal(t, []*string{aws.String("Sum")}, params.Statistics)
+
+	// namespaces without statistics fall back to the plugin default
+	m.Namespace = aws.String("AWS/EC2")
+	params = c.getStatisticsInput(m, time.Now())
+	assert.Equal(t, []*string{aws.String("Average"), aws.String("Sum")}, params.Statistics)
+
+	// metric filter statistics override the namespace statistics
+	m.Namespace = aws.String("AWS/Billing")
+	m.Filter = &Metric{Statistics: []string{"Maximum"}}
+	params = c.getStatisticsInput(m, time.Now())
+	assert.Equal(t, []*string{aws.String("Maximum")}, params.Statistics)
+}
+
+func TestGatherStatistics(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:     "us-east-1",
+		Namespace:  "AWS/ELB",
+		Delay:      internalDuration,
+		Period:     internalDuration,
+		RateLimit:  10,
+		Statistics: []string{"Average", "Sum"},
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	fields := map[string]interface{}{}
+	fields["latency_average"] = 0.2
+	fields["latency_sum"] = 123.0
+
+	assert.Equal(t, 1, len(acc.Metrics))
+	assert.Equal(t, fields, acc.Metrics[0].Fields)
+}
+
+type mockExtendedStatisticsCloudWatchClient struct {
+	mockGatherCloudWatchClient
+	requests []*cloudwatch.GetMetricStatisticsInput
+}
+
+func (m *mockExtendedStatisticsCloudWatchClient) GetMetricStatisticsWithContext(ctx aws.Context, params *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	m.requests = append(m.requests, params)
+	dataPoint := &cloudwatch.Datapoint{
+		Timestamp: params.EndTime,
+		Unit:      aws.String("Seconds"),
+	}
+	if len(params.Statistics) > 0 {
+		dataPoint.Average = aws.Float64(0.2)
+	}
+	if len(params.ExtendedStatistics) > 0 {
+		dataPoint.ExtendedStatistics = map[string]*float64{
+			"p95": aws.Float64(0.4),
+			"p99": aws.Float64(0.5),
+		}
+	}
+	result := &cloudwatch.GetMetricStatisticsOutput{
+		Label:      aws.String("Latency"),
+		Datapoints: []*cloudwatch.Datapoint{dataPoint},
+	}
+	return result, nil
+}
+
+func TestGatherExtendedStatistics(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:             "us-east-1",
+		Namespace:          "AWS/ELB",
+		Delay:              internalDuration,
+		Period:             internalDuration,
+		RateLimit:          10,
+		Statistics:         []string{"Average"},
+		ExtendedStatistics: []string{"p99"},
+	}
+
+	var acc testutil.Accumulator
+	client := &mockExtendedStatisticsCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: client}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	// statistics and extended statistics must be requested separately
+	assert.Len(t, client.requests, 2)
+
+	fields := map[string]interface{}{}
+	fields["latency_average"] = 0.2
+	fields["latency_p99"] = 0.5
+
+	tags := map[string]string{}
+	tags["unit"] = "seconds"
+	tags["region"] = "us-east-1"
+	tags["load_balancer_name"] = "p-example"
+
+	acc.AssertContainsTaggedFields(t, "cloudwatch_aws_elb", fields, tags)
+}
+
+func TestGenerateStatisticsInputParamsExtendedStatistics(t *testing.T) {
+	m := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			MetricName: aws.String("Latency"),
+		},
+	}
+
+	c := &CloudWatch{
+		Namespace:          "AWS/ELB",
+		ExtendedStatistics: []string{"p95", "p99"},
+	}
+
+	// only percentiles are requested when no statistics are configured
+	params := c.getStatisticsInput(m, time.Now())
+	assert.Len(t, params.Statistics, 0)
+	assert.Equal(t, []*string{aws.String("p95"), aws.String("p99")}, params.ExtendedStatistics)
+	assert.Len(t, splitStatisticsInput(params), 1)
+}
+
+func TestInitializeEndpointURL(t *testing.T) {
+	c := &CloudWatch{
+		Region:        "us-east-1",
+		EndpointURL:   "http://localhost:4566",
+		EnrichEc2Tags: true,
+	}
+
+	assert.NoError(t, c.initializeCloudWatch())
+	assert.Equal(t, "http://localhost:4566", c.clients["us-east-1"].(*cloudwatch.CloudWatch).Endpoint)
+	assert.Equal(t, "http://localhost:4566", c.ec2Clients["us-east-1"].(*ec2.EC2).Endpoint)
+}
+
+func TestInitializeFIPSEndpoint(t *testing.T) {
+	c := &CloudWatch{
+		Region:          "us-east-1",
+		UseFIPSEndpoint: true,
+		EnrichEc2Tags:   true,
+	}
+
+	assert.NoError(t, c.initializeCloudWatch())
+	assert.Equal(t, "https://monitoring-fips.us-east-1.amazonaws.com", c.clients["us-east-1"].(*cloudwatch.CloudWatch).Endpoint)
+	assert.Equal(t, "https://ec2-fips.us-east-1.amazonaws.com", c.ec2Clients["us-east-1"].(*ec2.EC2).Endpoint)
+}
+
+func TestInitializeDetectRegion(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("token"))
+	})
+	mux.HandleFunc("/latest/dynamic/instance-identity/document", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"region": "eu-west-1", "availabilityZone": "eu-west-1a"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// the region of the instance is used when none is configured
+	c := &CloudWatch{IMDSEndpoint: server.URL}
+	assert.NoError(t, c.initializeCloudWatch())
+	assert.Equal(t, "eu-west-1", c.Region)
+	assert.Equal(t, "https://monitoring.eu-west-1.amazonaws.com", c.clients["eu-west-1"].(*cloudwatch.CloudWatch).Endpoint)
+
+	// but not when configured
+	c = &CloudWatch{Region: "us-east-1", IMDSEndpoint: server.URL}
+	assert.NoError(t, c.initializeCloudWatch())
+	assert.Equal(t, "us-east-1", c.Region)
+
+	// and the region stays unset when the instance metadata is unavailable
+	c = &CloudWatch{
+		metadataRegion: func() (string, error) {
+			return "", errors.New("no instance metadata")
+		},
+	}
+	assert.NoError(t, c.initializeCloudWatch())
+	assert.Equal(t, "", c.Region)
+}
+
+func TestInitializeChinaRegion(t *testing.T) {
+	c := &CloudWatch{
+		Region:        "cn-north-1",
+		EnrichEc2Tags: true,
+		AccountIDTag:  true,
+	}
+
+	assert.NoError(t, c.initializeCloudWatch())
+	assert.Equal(t, "https://monitoring.cn-north-1.amazonaws.com.cn", c.clients["cn-north-1"].(*cloudwatch.CloudWatch).Endpoint)
+	assert.Equal(t, "https://ec2.cn-north-1.amazonaws.com.cn", c.ec2Clients["cn-north-1"].(*ec2.EC2).Endpoint)
+	assert.Equal(t, "https://sts.cn-north-1.amazonaws.com.cn", c.stsc.(*sts.STS).Endpoint)
+}
+
+func TestInitializeHTTPProxyURL(t *testing.T) {
+	c := &CloudWatch{
+		Region:       "us-east-1",
+		Namespace:    "AWS/ELB",
+		Period:       internal.Duration{Duration: time.Minute},
+		RateLimit:    10,
+		HTTPProxyURL: "http://proxy.example.com:3128",
+	}
+
+	assert.NoError(t, c.Init())
+	assert.NoError(t, c.initializeCloudWatch())
+
+	transport := c.clients["us-east-1"].(*cloudwatch.CloudWatch).Config.HTTPClient.Transport.(*http.Transport)
+	proxy, err := transport.Proxy(&http.Request{})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://proxy.example.com:3128", proxy.String())
+
+	c.HTTPProxyURL = "://proxy"
+	assert.Error(t, c.Init())
+}
+
+// fakeCloudWatchAPI is a fake SDK client, as written outside of the package.
+type fakeCloudWatchAPI struct {
+	cloudwatchiface.CloudWatchAPI
+	mock mockGatherCloudWatchClient
+}
+
+func (f *fakeCloudWatchAPI) ListMetricsWithContext(ctx aws.Context, params *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
+	return f.mock.ListMetricsWithContext(ctx, params, opts...)
+}
+
+func (f *fakeCloudWatchAPI) GetMetricStatisticsWithContext(ctx aws.Context, params *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	return f.mock.GetMetricStatisticsWithContext(ctx, params, opts...)
+}
+
+func TestSetClient(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Delay:     internalDuration,
+		Period:    internalDuration,
+		RateLimit: 10,
+	}
+	c.SetClient("us-east-1", &fakeCloudWatchAPI{})
+
+	var acc testutil.Accumulator
+	assert.NoError(t, c.Gather(&acc))
+	assert.True(t, acc.HasMeasurement("cloudwatch_aws_elb"))
+}
+
+func TestSetClientMissingClients(t *testing.T) {
+	// the missing clients fail their requests against the local endpoint
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:             "us-east-1",
+		Regions:            []string{"us-west-2"},
+		AccessKey:          "AKIDEXAMPLE",
+		SecretKey:          "secret",
+		EndpointURL:        server.URL,
+		Namespace:          "AWS/ELB",
+		Delay:              internalDuration,
+		Period:             internalDuration,
+		RateLimit:          10,
+		EnrichEc2Tags:      true,
+		EnrichRdsTags:      true,
+		EnrichResourceTags: true,
+	}
+	api := &fakeCloudWatchAPI{}
+	c.SetClient("us-east-1", api)
+
+	// the clients of other services and regions are created instead of
+	// failing the gather with a nil client, the listing of us-west-2 failing
+	var acc testutil.Accumulator
+	assert.Error(t, c.Gather(&acc))
+	assert.Equal(t, api, c.clients["us-east-1"])
+	for _, region := range c.regions() {
+		assert.NotNil(t, c.clients[region], region)
+		assert.NotNil(t, c.ec2Clients[region], region)
+		assert.NotNil(t, c.rdsClients[region], region)
+		assert.NotNil(t, c.resourceTagsClients[region], region)
+	}
+}
+
+func TestGatherInvalidPeriod(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 10,
+	}
+
+	requests := 0
+	c.SetClientFuncs(c.Region, &ClientFuncs{
+		ListMetrics: func(ctx context.Context, params *cloudwatch.ListMetricsInput) (*cloudwatch.ListMetricsOutput, error) {
+			requests++
+			return (&mockGatherCloudWatchClient{}).ListMetricsWithContext(ctx, params)
+		},
+		GetMetricStatistics: func(ctx context.Context, params *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+			requests++
+			return (&mockGatherCloudWatchClient{}).GetMetricStatisticsWithContext(ctx, params)
+		},
+	})
+
+	var acc testutil.Accumulator
+	assert.NoError(t, c.Gather(&acc))
+	assert.Equal(t, 2, requests)
+
+	// a period changed once initialized fails the gather at once, rather than
+	// every request
+	c.Period = internal.Duration{Duration: 90 * time.Second}
+	err := c.Gather(&acc)
+	assert.EqualError(t, err, "period must be a positive multiple of 60s, got 1m30s")
+	assert.Equal(t, 2, requests)
+}
+
+func TestInitRateLimit(t *testing.T) {
+	c := &CloudWatch{
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 0,
+	}
+	assert.Error(t, c.Init())
+
+	var acc testutil.Accumulator
+	assert.Error(t, c.Gather(&acc))
+
+	c.RateLimit = 10
+	assert.NoError(t, c.Init())
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name  string
+		cw    *CloudWatch
+		valid bool
+	}{
+		{
+			name: "valid",
+			cw: &CloudWatch{
+				Namespace:          "AWS/ELB",
+				Period:             internal.Duration{Duration: 5 * time.Minute},
+				Delay:              internal.Duration{Duration: 5 * time.Minute},
+				RateLimit:          10,
+				Statistics:         []string{"Average", "SampleCount"},
+				ExtendedStatistics: []string{"p99", "p99.9", "p100"},
+			},
+			valid: true,
+		},
+		{
+			name: "missing namespace",
+			cw: &CloudWatch{
+				Period:    internal.Duration{Duration: time.Minute},
+				RateLimit: 10,
+			},
+		},
+		{
+			name: "period not a multiple of 60s",
+			cw: &CloudWatch{
+				Namespace: "AWS/ELB",
+				Period:    internal.Duration{Duration: 90 * time.Second},
+				RateLimit: 10,
+			},
+		},
+		{
+			name: "high resolution period",
+			cw: &CloudWatch{
+				Namespace:      "Custom/App",
+				Period:         internal.Duration{Duration: time.Second},
+				HighResolution: true,
+				RateLimit:      10,
+			},
+			valid: true,
+		},
+		{
+			name: "invalid high resolution period",
+			cw: &CloudWatch{
+				Namespace:      "Custom/App",
+				Period:         internal.Duration{Duration: 15 * time.Second},
+				HighResolution: true,
+				RateLimit:      10,
+			},
+		},
+		{
+			name: "high resolution period without high_resolution",
+			cw: &CloudWatch{
+				Namespace: "Custom/App",
+				Period:    internal.Duration{Duration: 10 * time.Second},
+				RateLimit: 10,
+			},
+		},
+		{
+			name: "missing period",
+			cw: &CloudWatch{
+				Namespace: "AWS/ELB",
+				RateLimit: 10,
+			},
+		},
+		{
+			name: "negative delay",
+			cw: &CloudWatch{
+				Namespace: "AWS/ELB",
+				Period:    internal.Duration{Duration: time.Minute},
+				Delay:     internal.Duration{Duration: -time.Minute},
+				RateLimit: 10,
+			},
+		},
+		{
+			name: "negative backfill",
+			cw: &CloudWatch{
+				Namespace: "AWS/ELB",
+				Period:    internal.Duration{Duration: time.Minute},
+				Backfill:  internal.Duration{Duration: -time.Hour},
+				RateLimit: 10,
+			},
+		},
+		{
+			name: "linked accounts without get metric data",
+			cw: &CloudWatch{
+				Namespace:      "AWS/ELB",
+				Period:         internal.Duration{Duration: time.Minute},
+				RateLimit:      10,
+				LinkedAccounts: true,
+			},
+		},
+		{
+			name: "metric account id without linked accounts",
+			cw: &CloudWatch{
+				Namespace:        "AWS/ELB",
+				Period:           internal.Duration{Duration: time.Minute},
+				RateLimit:        10,
+				UseGetMetricData: true,
+				Metrics: []*Metric{
+					&Metric{MetricNames: []string{"Latency"}, AccountID: "123456789012"},
+				},
+			},
+		},
+		{
+			name: "anomaly band without get metric data",
+			cw: &CloudWatch{
+				Namespace: "AWS/ELB",
+				Period:    internal.Duration{Duration: time.Minute},
+				RateLimit: 10,
+				Metrics: []*Metric{
+					&Metric{MetricNames: []string{"Latency"}, AnomalyBand: 2},
+				},
+			},
+		},
+		{
+			name: "empty statistic label",
+			cw: &CloudWatch{
+				Namespace:       "AWS/ELB",
+				Period:          internal.Duration{Duration: time.Minute},
+				RateLimit:       10,
+				StatisticLabels: map[string]string{"Average": ""},
+			},
+		},
+		{
+			name: "invalid statistic label statistic",
+			cw: &CloudWatch{
+				Namespace:       "AWS/ELB",
+				Period:          internal.Duration{Duration: time.Minute},
+				RateLimit:       10,
+				StatisticLabels: map[string]string{"avg": "a"},
+			},
+		},
+		{
+			name: "invalid statistic label percentile",
+			cw: &CloudWatch{
+				Namespace:       "AWS/ELB",
+				Period:          internal.Duration{Duration: time.Minute},
+				RateLimit:       10,
+				StatisticLabels: map[string]string{"p99.9x": "p999"},
+			},
+		},
+		{
+			name: "ec2 tagged instances only without tag keys",
+			cw: &CloudWatch{
+				Namespace:     "AWS/EC2",
+				Period:        internal.Duration{Duration: time.Minute},
+				RateLimit:     10,
+				EnrichEc2Tags: true,
+				Ec2TaggedOnly: true,
+			},
+		},
+		{
+			name: "negative credential set weight",
+			cw: &CloudWatch{
+				Namespace:      "AWS/ELB",
+				Period:         internal.Duration{Duration: time.Minute},
+				RateLimit:      10,
+				CredentialSets: []*CredentialSet{&CredentialSet{RoleARN: "arn:aws:iam::123456789012:role/telegraf", Weight: -1}},
+			},
+		},
+		{
+			name: "resource tag filter without key",
+			cw: &CloudWatch{
+				Namespace:          "AWS/EC2",
+				Period:             internal.Duration{Duration: time.Minute},
+				RateLimit:          10,
+				ResourceTagFilters: []*ResourceTagFilter{&ResourceTagFilter{Values: []string{"prod"}}},
+			},
+		},
+		{
+			name: "invalid unit label unit",
+			cw: &CloudWatch{
+				Namespace:  "AWS/ELB",
+				Period:     internal.Duration{Duration: time.Minute},
+				RateLimit:  10,
+				UnitLabels: map[string]string{"Seconds/Second": "s"},
+			},
+		},
+		{
+			name: "shard index out of range",
+			cw: &CloudWatch{
+				Namespace:  "AWS/ELB",
+				Period:     internal.Duration{Duration: time.Minute},
+				RateLimit:  10,
+				ShardIndex: 2,
+				ShardTotal: 2,
+			},
+		},
+		{
+			name: "negative shard total",
+			cw: &CloudWatch{
+				Namespace:  "AWS/ELB",
+				Period:     internal.Duration{Duration: time.Minute},
+				RateLimit:  10,
+				ShardTotal: -1,
+			},
+		},
+		{
+			name: "invalid namespace delay",
+			cw: &CloudWatch{
+				Namespace:       "AWS/ELB",
+				Period:          internal.Duration{Duration: time.Minute},
+				RateLimit:       10,
+				NamespaceDelays: map[string]string{"AWS/ELB": "1 hour"},
+			},
+		},
+		{
+			name: "negative namespace delay",
+			cw: &CloudWatch{
+				Namespace:       "AWS/ELB",
+				Period:          internal.Duration{Duration: time.Minute},
+				RateLimit:       10,
+				NamespaceDelays: map[string]string{"AWS/ELB": "-1h"},
+			},
+		},
+		{
+			name: "invalid statistic",
+			cw: &CloudWatch{
+				Namespace:  "AWS/ELB",
+				Period:     internal.Duration{Duration: time.Minute},
+				RateLimit:  10,
+				Statistics: []string{"Median"},
+			},
+		},
+		{
+			name: "invalid namespace statistic",
+			cw: &CloudWatch{
+				Namespace:           "AWS/ELB",
+				Period:              internal.Duration{Duration: time.Minute},
+				RateLimit:           10,
+				NamespaceStatistics: map[string][]string{"AWS/ELB": []string{"Median"}},
+			},
+		},
+		{
+			name: "invalid extended statistic",
+			cw: &CloudWatch{
+				Namespace:          "AWS/ELB",
+				Period:             internal.Duration{Duration: time.Minute},
+				RateLimit:          10,
+				ExtendedStatistics: []string{"p101"},
+			},
+		},
+		{
+			name: "negative timeout",
+			cw: &CloudWatch{
+				Namespace: "AWS/ELB",
+				Period:    internal.Duration{Duration: time.Minute},
+				RateLimit: 10,
+				Timeout:   internal.Duration{Duration: -time.Second},
+			},
+		},
+		{
+			name: "negative gather jitter",
+			cw: &CloudWatch{
+				Namespace:    "AWS/ELB",
+				Period:       internal.Duration{Duration: time.Minute},
+				RateLimit:    10,
+				GatherJitter: internal.Duration{Duration: -time.Second},
+			},
+		},
+		{
+			name: "negative max concurrent requests",
+			cw: &CloudWatch{
+				Namespace:     "AWS/ELB",
+				Period:        internal.Duration{Duration: time.Minute},
+				RateLimit:     10,
+				MaxConcurrent: -1,
+			},
+		},
+		{
+			name: "tag rename without to",
+			cw: &CloudWatch{
+				Namespace:  "AWS/ELB",
+				Period:     internal.Duration{Duration: time.Minute},
+				RateLimit:  10,
+				TagRenames: []*TagRename{&TagRename{From: "LoadBalancerName"}},
+			},
+		},
+		{
+			name: "invalid fill",
+			cw: &CloudWatch{
+				Namespace: "AWS/ELB",
+				Period:    internal.Duration{Duration: time.Minute},
+				RateLimit: 10,
+				Fill:      "linear",
+			},
+		},
+		{
+			name: "invalid exclude_names pattern",
+			cw: &CloudWatch{
+				Namespace:    "AWS/ELB",
+				Period:       internal.Duration{Duration: time.Minute},
+				RateLimit:    10,
+				ExcludeNames: []string{"HTTPCode_[4"},
+			},
+		},
+		{
+			name: "metric unit",
+			cw: &CloudWatch{
+				Namespace: "AWS/EC2",
+				Period:    internal.Duration{Duration: time.Minute},
+				RateLimit: 10,
+				Metrics: []*Metric{
+					&Metric{Unit: "Count/Second"},
+				},
+			},
+			valid: true,
+		},
+		{
+			name: "invalid metric unit",
+			cw: &CloudWatch{
+				Namespace: "AWS/EC2",
+				Period:    internal.Duration{Duration: time.Minute},
+				RateLimit: 10,
+				Metrics: []*Metric{
+					&Metric{Unit: "bytes"},
+				},
+			},
+		},
+		{
+			name: "invalid metric period",
+			cw: &CloudWatch{
+				Namespace: "AWS/ELB",
+				Period:    internal.Duration{Duration: time.Minute},
+				RateLimit: 10,
+				Metrics: []*Metric{
+					&Metric{Period: internal.Duration{Duration: 30 * time.Second}},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		err := tt.cw.Init()
+		if tt.valid {
+			assert.NoError(t, err, tt.name)
+		} else {
+			assert.Error(t, err, tt.name)
+		}
+	}
+}
+
+func TestDefaultCacheTTL(t *testing.T) {
+	c := inputs.Inputs["cloudwatch"]().(*CloudWatch)
+	assert.Equal(t, time.Hour, c.CacheTTL.Duration)
+}
+
+func TestMetricsCacheTimeout(t *testing.T) {
+	ttl, _ := time.ParseDuration("5ms")
+	cache := &MetricCache{
+		Metrics: []*cloudwatch.Metric{},
+		Fetched: time.Now(),
+		TTL:     ttl,
+		fetched: true,
+	}
+
+	assert.True(t, cache.IsValid())
+	time.Sleep(ttl)
+	assert.False(t, cache.IsValid())
+}
+
+func TestMetricsCacheNeverFetched(t *testing.T) {
+	cache := &MetricCache{
+		Fetched: time.Now(),
+		TTL:     time.Hour,
+	}
+
+	assert.False(t, cache.IsValid())
+}
+
+type mockEmptyCloudWatchClient struct {
+	mockGatherCloudWatchClient
+	calls int
+}
+
+func (m *mockEmptyCloudWatchClient) ListMetricsWithContext(ctx aws.Context, params *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
+	m.calls++
+	return &cloudwatch.ListMetricsOutput{}, nil
+}
+
+func TestFetchEmptyNamespaceCached(t *testing.T) {
+	client := &mockEmptyCloudWatchClient{}
+	c := &CloudWatch{
+		Namespaces: []string{"Custom/Idle"},
+		CacheTTL:   internal.Duration{Duration: time.Hour},
+		RateLimit:  10,
+		clients:    map[string]cloudwatchClient{"": client},
+	}
+
+	for i := 0; i < 2; i++ {
+		metrics, err := c.fetchNamespaceMetrics(nil)
+		assert.NoError(t, err)
+		assert.Len(t, metrics, 0)
+	}
+	assert.Equal(t, 1, client.calls)
+}
+
+type mockThrottledCloudWatchClient struct {
+	mockGatherCloudWatchClient
+	calls int
+}
+
+func (m *mockThrottledCloudWatchClient) ListMetricsWithContext(ctx aws.Context, params *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
+	m.calls++
+	if m.calls > 1 {
+		return nil, awserr.New("Throttling", "Rate exceeded", nil)
+	}
+	return m.mockGatherCloudWatchClient.ListMetricsWithContext(ctx, params, opts...)
+}
+
+func TestFetchMetricsExpiredCacheFallback(t *testing.T) {
+	client := &mockThrottledCloudWatchClient{}
+	c := &CloudWatch{
+		Namespaces: []string{"AWS/ELB"},
+		CacheTTL:   internal.Duration{Duration: time.Nanosecond},
+		RateLimit:  10,
+		clients:    map[string]cloudwatchClient{"": client},
+	}
+
+	metrics, err := c.fetchNamespaceMetrics(nil)
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 1)
+
+	// the expired listing is kept when listing again fails
+	metrics, err = c.fetchNamespaceMetrics(nil)
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, 2, client.calls)
+
+	// but listing fails without any cached listing
+	c.metricCache = nil
+	_, err = c.fetchNamespaceMetrics(nil)
+	assert.Error(t, err)
+}
+
+func TestGatherRenewExpiredCredentialsSetClient(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Regions:   []string{"us-west-2"},
+		Namespace: "AWS/ELB",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 10,
+	}
+
+	funcs := &ClientFuncs{
+		ListMetrics: func(ctx context.Context, params *cloudwatch.ListMetricsInput) (*cloudwatch.ListMetricsOutput, error) {
+			return nil, awserr.New("ExpiredToken", "The security token included in the request is expired", nil)
+		},
+	}
+	c.SetClientFuncs("us-east-1", funcs)
+	c.clients["us-west-2"] = &mockGatherCloudWatchClient{}
+
+	// only the clients that were not set are created again
+	var acc testutil.Accumulator
+	assert.Error(t, c.Gather(&acc))
+	assert.Equal(t, funcs, c.clients["us-east-1"])
+	assert.IsType(t, &cloudwatch.CloudWatch{}, c.clients["us-west-2"])
+}
+
+type mockExpiredCloudWatchClient struct {
+	mockGatherCloudWatchClient
+}
+
+func (m *mockExpiredCloudWatchClient) GetMetricStatisticsWithContext(ctx aws.Context, params *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	return nil, awserr.New("ExpiredToken", "The security token included in the request is expired", nil)
+}
+
+func TestGatherRenewExpiredCredentials(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/ELB",
+		Delay:     internalDuration,
+		Period:    internalDuration,
+		RateLimit: 10,
+	}
+
+	var acc testutil.Accumulator
+	client := &mockExpiredCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: client}
+
+	// the clients are created again for the next gather
+	assert.Error(t, c.Gather(&acc))
+	assert.NotEqual(t, client, c.clients[c.Region])
+	assert.IsType(t, &cloudwatch.CloudWatch{}, c.clients[c.Region])
+	assert.False(t, c.credentialsExpired)
+
+	// but are kept on other errors
+	c.clients = map[string]cloudwatchClient{c.Region: &mockThrottledCloudWatchClient{calls: 1}}
+	c.metricCache = nil
+	assert.Error(t, c.Gather(&acc))
+	assert.IsType(t, &mockThrottledCloudWatchClient{}, c.clients[c.Region])
+}
+
+func TestFetchNamespaceMetricsConcurrently(t *testing.T) {
+	c := &CloudWatch{
+		Namespaces: []string{"AWS/ELB", "AWS/EC2", "AWS/RDS", "AWS/SQS"},
+		CacheTTL:   internal.Duration{Duration: time.Hour},
+		RateLimit:  100,
+		clients:    map[string]cloudwatchClient{"": &mockGatherCloudWatchClient{}},
+	}
+
+	metrics, err := c.fetchNamespaceMetrics(nil)
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 4)
+	for i, namespace := range c.Namespaces {
+		assert.Equal(t, namespace, *metrics[i].Namespace)
+	}
+	assert.Len(t, c.metricCache[""], 4)
 }
@@ -0,0 +1,106 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+
+	internalaws "github.com/influxdata/telegraf/internal/config/aws"
+)
+
+type (
+	// CredentialSet is one of the credentials CloudWatch requests are
+	// distributed across, to spread them over the API quotas of several
+	// principals of the same account, as the pages of a listing may be
+	// requested with different sets. The fields set override the
+	// credentials of the plugin, RoleARN replacing both its role_arn and
+	// role_arns. A set is picked Weight times as often as a set of weight 1.
+	CredentialSet struct {
+		AccessKey string `toml:"access_key"`
+		SecretKey string `toml:"secret_key"`
+		Token     string `toml:"token"`
+		RoleARN   string `toml:"role_arn"`
+		Profile   string `toml:"profile"`
+		Weight    int    `toml:"weight"`
+	}
+
+	// roundRobinClient sends every request with the next of its clients,
+	// each client being listed as many times as the weight of its set.
+	roundRobinClient struct {
+		clients []cloudwatchClient
+		next    uint64
+	}
+)
+
+/*
+ * Check the configured credential sets
+ */
+func (c *CloudWatch) checkCredentialSets() error {
+	for i, set := range c.CredentialSets {
+		if set.Weight < 0 {
+			return fmt.Errorf("credential set %d: weight must not be negative, got %d", i+1, set.Weight)
+		}
+	}
+	return nil
+}
+
+/*
+ * Build the credential config of given set from the one of the plugin
+ */
+func (s *CredentialSet) credentialConfig(config *internalaws.CredentialConfig) *internalaws.CredentialConfig {
+	if s.AccessKey != "" || s.SecretKey != "" {
+		config.AccessKey = s.AccessKey
+		config.SecretKey = s.SecretKey
+		config.Token = s.Token
+	}
+	if s.Profile != "" {
+		config.Profile = s.Profile
+	}
+	if s.RoleARN != "" {
+		config.RoleARN = s.RoleARN
+		config.RoleARNs = nil
+	}
+	return config
+}
+
+func (s *CredentialSet) weight() int {
+	if s.Weight == 0 {
+		return 1
+	}
+	return s.Weight
+}
+
+/*
+ * Create the CloudWatch client of given region distributing requests across
+ * the credential sets
+ */
+func (c *CloudWatch) newRoundRobinClient(region string, config *aws.Config) *roundRobinClient {
+	rr := &roundRobinClient{}
+	for _, set := range c.CredentialSets {
+		client := cloudwatch.New(set.credentialConfig(c.credentialConfig(region)).Credentials(), config)
+		for i := 0; i < set.weight(); i++ {
+			rr.clients = append(rr.clients, client)
+		}
+	}
+	return rr
+}
+
+func (rr *roundRobinClient) client() cloudwatchClient {
+	n := atomic.AddUint64(&rr.next, 1)
+	return rr.clients[(n-1)%uint64(len(rr.clients))]
+}
+
+func (rr *roundRobinClient) ListMetricsWithContext(ctx aws.Context, params *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
+	return rr.client().ListMetricsWithContext(ctx, params, opts...)
+}
+
+func (rr *roundRobinClient) GetMetricStatisticsWithContext(ctx aws.Context, params *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	return rr.client().GetMetricStatisticsWithContext(ctx, params, opts...)
+}
+
+func (rr *roundRobinClient) GetMetricDataWithContext(ctx aws.Context, params *cloudwatch.GetMetricDataInput, opts ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	return rr.client().GetMetricDataWithContext(ctx, params, opts...)
+}
@@ -0,0 +1,76 @@
+package cloudwatch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	internalaws "github.com/influxdata/telegraf/internal/config/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundRobinClient(t *testing.T) {
+	calls := map[string]int{}
+	clientFuncs := func(name string) *ClientFuncs {
+		return &ClientFuncs{
+			ListMetrics: func(ctx context.Context, params *cloudwatch.ListMetricsInput) (*cloudwatch.ListMetricsOutput, error) {
+				calls[name]++
+				return &cloudwatch.ListMetricsOutput{}, nil
+			},
+		}
+	}
+
+	// the first set has a weight of 2
+	a, b := clientFuncs("a"), clientFuncs("b")
+	rr := &roundRobinClient{clients: []cloudwatchClient{a, a, b}}
+	for i := 0; i < 6; i++ {
+		_, err := rr.ListMetricsWithContext(context.Background(), &cloudwatch.ListMetricsInput{})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, map[string]int{"a": 4, "b": 2}, calls)
+}
+
+func TestCredentialSetConfig(t *testing.T) {
+	base := func() *internalaws.CredentialConfig {
+		return &internalaws.CredentialConfig{
+			Region:         "us-east-1",
+			Profile:        "default",
+			RoleARN:        "arn:aws:iam::123456789012:role/base",
+			RoleARNs:       []string{"arn:aws:iam::123456789012:role/next"},
+			RoleExternalID: "external",
+		}
+	}
+
+	// the role replaces the roles of the plugin, the other settings are kept
+	set := &CredentialSet{RoleARN: "arn:aws:iam::123456789012:role/telegraf-1"}
+	config := set.credentialConfig(base())
+	assert.Equal(t, "arn:aws:iam::123456789012:role/telegraf-1", config.RoleARN)
+	assert.Nil(t, config.RoleARNs)
+	assert.Equal(t, "default", config.Profile)
+	assert.Equal(t, "external", config.RoleExternalID)
+	assert.Equal(t, "us-east-1", config.Region)
+
+	set = &CredentialSet{AccessKey: "AKIDEXAMPLE", SecretKey: "secret", Profile: "other"}
+	config = set.credentialConfig(base())
+	assert.Equal(t, "AKIDEXAMPLE", config.AccessKey)
+	assert.Equal(t, "secret", config.SecretKey)
+	assert.Equal(t, "other", config.Profile)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/base", config.RoleARN)
+}
+
+func TestInitializeCredentialSets(t *testing.T) {
+	c := &CloudWatch{
+		Region: "us-east-1",
+		CredentialSets: []*CredentialSet{
+			&CredentialSet{AccessKey: "AKID1", SecretKey: "secret", Weight: 2},
+			&CredentialSet{AccessKey: "AKID2", SecretKey: "secret"},
+		},
+	}
+
+	assert.NoError(t, c.initializeCloudWatch())
+	rr, ok := c.clients["us-east-1"].(*roundRobinClient)
+	assert.True(t, ok)
+	assert.Len(t, rr.clients, 3)
+	assert.Equal(t, "us-east-1", aws.StringValue(rr.clients[2].(*cloudwatch.CloudWatch).Config.Region))
+}
@@ -0,0 +1,205 @@
+package cloudwatch
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	// instanceIDDimension is the dimension name identifying EC2 instances.
+	instanceIDDimension = "InstanceId"
+
+	// availabilityZoneTag is the tag set to the availability zone of EC2
+	// instances.
+	availabilityZoneTag = "availability_zone"
+
+	// maxEc2DescribeResults is the maximum number of instances described
+	// by a single DescribeInstances request.
+	maxEc2DescribeResults = 1000
+)
+
+type (
+	// TagCache holds the tags of resources keyed by the value of the
+	// Dimension identifying them in metrics, or by ARN when Dimension is
+	// empty. Tags are refreshed every RefreshInterval, and the tags of a
+	// resource are kept for TTL after it was last seen.
+	TagCache struct {
+		TTL             time.Duration
+		RefreshInterval time.Duration
+		Fetched         time.Time
+		Dimension       string
+		Tags            map[string]map[string]string
+
+		seen map[string]time.Time
+		// resources maps the "name=value" dimensions identifying resources
+		// to their ARN
+		resources map[string]string
+	}
+
+	// Ec2InstanceFilter limits the EC2 instances whose tags are fetched to
+	// the ones matching one of Values for the DescribeInstances filter Name.
+	Ec2InstanceFilter struct {
+		Name   string   `toml:"name"`
+		Values []string `toml:"values"`
+	}
+
+	ec2Client interface {
+		DescribeInstancesWithContext(aws.Context, *ec2.DescribeInstancesInput, ...request.Option) (*ec2.DescribeInstancesOutput, error)
+	}
+)
+
+/*
+ * Fetch the configured tags and the availability zone of every EC2 instance
+ * in given region
+ */
+func (c *CloudWatch) fetchEc2Tags(region string) error {
+	cache := c.tagsCache[region]
+	if cache != nil && cache.IsValid() {
+		return nil
+	}
+
+	now := time.Now()
+	tags := map[string]map[string]string{}
+	seen := map[string]time.Time{}
+
+	// DescribeInstances has no projection of the described fields, so the
+	// instances are narrowed instead and only their needed fields cached
+	params := &ec2.DescribeInstancesInput{MaxResults: aws.Int64(maxEc2DescribeResults)}
+	for _, f := range c.Ec2InstanceFilters {
+		params.Filters = append(params.Filters, &ec2.Filter{
+			Name:   aws.String(f.Name),
+			Values: aws.StringSlice(f.Values),
+		})
+	}
+	if c.Ec2TaggedOnly {
+		params.Filters = append(params.Filters, &ec2.Filter{
+			Name:   aws.String("tag-key"),
+			Values: aws.StringSlice(c.Ec2TagKeys),
+		})
+	}
+
+	for more := true; more; {
+		ctx, cancel := c.requestContext()
+		resp, err := c.ec2Clients[region].DescribeInstancesWithContext(ctx, params)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		for _, reservation := range resp.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.InstanceId == nil {
+					continue
+				}
+				instanceTags := map[string]string{}
+				if instance.Placement != nil && aws.StringValue(instance.Placement.AvailabilityZone) != "" {
+					instanceTags[availabilityZoneTag] = *instance.Placement.AvailabilityZone
+				}
+				for _, tag := range instance.Tags {
+					if contains(c.Ec2TagKeys, aws.StringValue(tag.Key)) {
+						instanceTags[*tag.Key] = aws.StringValue(tag.Value)
+					}
+				}
+				tags[*instance.InstanceId] = instanceTags
+				seen[*instance.InstanceId] = now
+			}
+		}
+
+		params.NextToken = resp.NextToken
+		more = resp.NextToken != nil
+	}
+
+	if c.tagsCache == nil {
+		c.tagsCache = map[string]*TagCache{}
+	}
+	c.tagsCache[region] = c.newTagCache(cache, c.ec2TagDimension(), tags, seen, now)
+
+	return nil
+}
+
+/*
+ * Create the Tag Cache of freshly fetched tags, keeping the tags of resources
+ * no longer returned, e.g. terminated, for their delayed metrics
+ */
+func (c *CloudWatch) newTagCache(
+	previous *TagCache,
+	dimension string,
+	tags map[string]map[string]string,
+	seen map[string]time.Time,
+	now time.Time,
+) *TagCache {
+	if previous != nil {
+		for id, resourceTags := range previous.Tags {
+			if _, ok := tags[id]; !ok && now.Sub(previous.seen[id]) < c.Ec2TagCacheTTL.Duration {
+				tags[id] = resourceTags
+				seen[id] = previous.seen[id]
+			}
+		}
+	}
+
+	return &TagCache{
+		Tags:            tags,
+		Fetched:         now,
+		Dimension:       dimension,
+		TTL:             c.Ec2TagCacheTTL.Duration,
+		RefreshInterval: c.Ec2TagRefreshInterval.Duration,
+		seen:            seen,
+	}
+}
+
+/*
+ * Add the EC2 tags of the instance identified by the InstanceId dimension, or
+ * the configured one, of given Metric, if any
+ */
+func (c *CloudWatch) addEc2Tags(metric *SelectedMetric, tags map[string]string) {
+	cache := c.tagsCache[metric.Region]
+	if cache == nil {
+		return
+	}
+
+	c.copyTags(tags, cache.dimensionTags(metric.Dimensions))
+}
+
+/*
+ * Get the dimension identifying EC2 instances in metrics
+ */
+func (c *CloudWatch) ec2TagDimension() string {
+	if c.Ec2TagDimension != "" {
+		return c.Ec2TagDimension
+	}
+	return instanceIDDimension
+}
+
+/*
+ * Check Tag Cache validity
+ */
+func (c *TagCache) IsValid() bool {
+	return c.Tags != nil && time.Since(c.Fetched) < c.RefreshInterval
+}
+
+/*
+ * Get the tags of the resource identified by the cache dimension among given
+ * metric dimensions, unless expired
+ */
+func (c *TagCache) dimensionTags(dimensions []*cloudwatch.Dimension) map[string]string {
+	for _, d := range dimensions {
+		if aws.StringValue(d.Name) == c.Dimension {
+			return c.get(aws.StringValue(d.Value))
+		}
+	}
+	return nil
+}
+
+/*
+ * Get the tags of given resource, unless expired
+ */
+func (c *TagCache) get(id string) map[string]string {
+	if time.Since(c.seen[id]) >= c.TTL {
+		return nil
+	}
+	return c.Tags[id]
+}
@@ -0,0 +1,374 @@
+package cloudwatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockInstanceCloudWatchClient struct {
+	mockGatherCloudWatchClient
+}
+
+func (m *mockInstanceCloudWatchClient) ListMetricsWithContext(ctx aws.Context, params *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
+	metric := &cloudwatch.Metric{
+		Namespace:  params.Namespace,
+		MetricName: aws.String("VolumeReadOps"),
+		Dimensions: []*cloudwatch.Dimension{
+			&cloudwatch.Dimension{
+				Name:  aws.String("InstanceId"),
+				Value: aws.String("i-2"),
+			},
+		},
+	}
+
+	result := &cloudwatch.ListMetricsOutput{
+		Metrics: []*cloudwatch.Metric{metric},
+	}
+	return result, nil
+}
+
+type mockEc2Client struct {
+	calls   int
+	filters []*ec2.Filter
+}
+
+func (m *mockEc2Client) DescribeInstancesWithContext(ctx aws.Context, params *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	m.calls++
+	m.filters = params.Filters
+
+	// return one instance per page
+	if params.NextToken == nil {
+		return &ec2.DescribeInstancesOutput{
+			NextToken: aws.String("page-2"),
+			Reservations: []*ec2.Reservation{
+				&ec2.Reservation{
+					Instances: []*ec2.Instance{
+						&ec2.Instance{
+							InstanceId: aws.String("i-1"),
+							Tags: []*ec2.Tag{
+								&ec2.Tag{Key: aws.String("Name"), Value: aws.String("web-1")},
+							},
+						},
+					},
+				},
+			},
+		}, nil
+	}
+
+	return &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			&ec2.Reservation{
+				Instances: []*ec2.Instance{
+					&ec2.Instance{
+						InstanceId: aws.String("i-2"),
+						Placement: &ec2.Placement{
+							AvailabilityZone: aws.String("us-east-1a"),
+						},
+						Tags: []*ec2.Tag{
+							&ec2.Tag{Key: aws.String("Name"), Value: aws.String("db-1")},
+							&ec2.Tag{Key: aws.String("env"), Value: aws.String("prod")},
+						},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+func TestFetchEc2TagsPagination(t *testing.T) {
+	client := &mockEc2Client{}
+	c := &CloudWatch{
+		Ec2TagKeys:            []string{"Name"},
+		Ec2TagCacheTTL:        internal.Duration{Duration: time.Hour},
+		Ec2TagRefreshInterval: internal.Duration{Duration: time.Hour},
+		ec2Clients:            map[string]ec2Client{"": client},
+	}
+
+	assert.NoError(t, c.fetchEc2Tags(""))
+	assert.Equal(t, 2, client.calls)
+	assert.Len(t, c.tagsCache[""].Tags, 2)
+	assert.Equal(t, "web-1", c.tagsCache[""].Tags["i-1"]["Name"])
+	assert.Equal(t, "db-1", c.tagsCache[""].Tags["i-2"]["Name"])
+
+	// cached tags are not fetched again
+	assert.NoError(t, c.fetchEc2Tags(""))
+	assert.Equal(t, 2, client.calls)
+}
+
+func TestFetchEc2TagsFilters(t *testing.T) {
+	client := &mockEc2Client{}
+	c := &CloudWatch{
+		Ec2TagKeys: []string{"Name"},
+		Ec2InstanceFilters: []*Ec2InstanceFilter{
+			&Ec2InstanceFilter{Name: "tag:env", Values: []string{"prod", "staging"}},
+			&Ec2InstanceFilter{Name: "vpc-id", Values: []string{"vpc-1"}},
+		},
+		Ec2TagCacheTTL:        internal.Duration{Duration: time.Hour},
+		Ec2TagRefreshInterval: internal.Duration{Duration: time.Hour},
+		ec2Clients:            map[string]ec2Client{"": client},
+	}
+
+	assert.NoError(t, c.fetchEc2Tags(""))
+
+	// filters are kept on every page
+	filters := []*ec2.Filter{
+		&ec2.Filter{Name: aws.String("tag:env"), Values: aws.StringSlice([]string{"prod", "staging"})},
+		&ec2.Filter{Name: aws.String("vpc-id"), Values: aws.StringSlice([]string{"vpc-1"})},
+	}
+	assert.Equal(t, 2, client.calls)
+	assert.Equal(t, filters, client.filters)
+
+	// only instances having one of the tag keys are described when enabled
+	c.Ec2TaggedOnly = true
+	c.tagsCache = nil
+	assert.NoError(t, c.fetchEc2Tags(""))
+	filters = append(filters, &ec2.Filter{Name: aws.String("tag-key"), Values: aws.StringSlice([]string{"Name"})})
+	assert.Equal(t, filters, client.filters)
+}
+
+func TestGatherEnrichEc2Tags(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:        "us-east-1",
+		Namespace:     "AWS/EBS",
+		Delay:         internalDuration,
+		Period:        internalDuration,
+		RateLimit:     10,
+		EnrichEc2Tags: true,
+		Ec2TagKeys:    []string{"Name", "env"},
+
+		Ec2TagCacheTTL: internal.Duration{Duration: time.Hour},
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockInstanceCloudWatchClient{}}
+	c.ec2Clients = map[string]ec2Client{c.Region: &mockEc2Client{}}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	tags := map[string]string{}
+	tags["unit"] = "seconds"
+	tags["region"] = "us-east-1"
+	tags["instance_id"] = "i-2"
+	tags["availability_zone"] = "us-east-1a"
+	tags["Name"] = "db-1"
+	tags["env"] = "prod"
+
+	assert.True(t, acc.HasMeasurement("cloudwatch_aws_ebs"))
+	assert.Equal(t, tags, acc.Metrics[0].Tags)
+}
+
+func TestAddEc2TagsDimension(t *testing.T) {
+	c := &CloudWatch{
+		Ec2TagKeys:            []string{"Name"},
+		Ec2TagDimension:       "HostId",
+		Ec2TagCacheTTL:        internal.Duration{Duration: time.Hour},
+		Ec2TagRefreshInterval: internal.Duration{Duration: time.Hour},
+		ec2Clients:            map[string]ec2Client{"": &mockEc2Client{}},
+	}
+	assert.NoError(t, c.fetchEc2Tags(""))
+
+	metric := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			Namespace:  aws.String("Custom/Hosts"),
+			MetricName: aws.String("Load"),
+			Dimensions: []*cloudwatch.Dimension{
+				&cloudwatch.Dimension{Name: aws.String("InstanceId"), Value: aws.String("i-1")},
+				&cloudwatch.Dimension{Name: aws.String("HostId"), Value: aws.String("i-2")},
+			},
+		},
+	}
+
+	// the instance is identified by the configured dimension only
+	tags := map[string]string{}
+	c.addEc2Tags(metric, tags)
+	assert.Equal(t, "db-1", tags["Name"])
+}
+
+func TestAddEc2TagsSkipEmpty(t *testing.T) {
+	c := &CloudWatch{
+		tagsCache: map[string]*TagCache{
+			"": &TagCache{
+				TTL:       time.Hour,
+				Dimension: instanceIDDimension,
+				Tags:      map[string]map[string]string{"i-1": {"Name": "", "env": "prod"}},
+				seen:      map[string]time.Time{"i-1": time.Now()},
+			},
+		},
+	}
+	metric := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			Namespace:  aws.String("AWS/EC2"),
+			MetricName: aws.String("CPUUtilization"),
+			Dimensions: []*cloudwatch.Dimension{
+				&cloudwatch.Dimension{Name: aws.String("InstanceId"), Value: aws.String("i-1")},
+			},
+		},
+	}
+
+	tags := map[string]string{}
+	c.addEc2Tags(metric, tags)
+	assert.Equal(t, map[string]string{"Name": "", "env": "prod"}, tags)
+
+	c.SkipEmptyTags = true
+	tags = map[string]string{}
+	c.addEc2Tags(metric, tags)
+	assert.Equal(t, map[string]string{"env": "prod"}, tags)
+}
+
+type mockTerminatedEc2Client struct{}
+
+func (m *mockTerminatedEc2Client) DescribeInstancesWithContext(ctx aws.Context, params *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	return &ec2.DescribeInstancesOutput{}, nil
+}
+
+func TestFetchEc2TagsRefresh(t *testing.T) {
+	c := &CloudWatch{
+		Ec2TagKeys:            []string{"Name"},
+		Ec2TagCacheTTL:        internal.Duration{Duration: time.Hour},
+		Ec2TagRefreshInterval: internal.Duration{Duration: time.Millisecond},
+		ec2Clients:            map[string]ec2Client{"": &mockEc2Client{}},
+	}
+	assert.NoError(t, c.fetchEc2Tags(""))
+
+	// refreshed tags of instances no longer described are kept for the TTL
+	time.Sleep(time.Millisecond)
+	c.ec2Clients = map[string]ec2Client{c.Region: &mockTerminatedEc2Client{}}
+	assert.False(t, c.tagsCache[""].IsValid())
+	assert.NoError(t, c.fetchEc2Tags(""))
+	assert.Equal(t, "db-1", c.tagsCache[""].get("i-2")["Name"])
+
+	// and expire afterwards
+	c.tagsCache[""].TTL = 0
+	assert.Nil(t, c.tagsCache[""].get("i-2"))
+}
+
+func TestFetchEc2TagsKeys(t *testing.T) {
+	c := &CloudWatch{
+		Ec2TagKeys:            []string{"env"},
+		Ec2TagCacheTTL:        internal.Duration{Duration: time.Hour},
+		Ec2TagRefreshInterval: internal.Duration{Duration: time.Hour},
+		ec2Clients:            map[string]ec2Client{"": &mockEc2Client{}},
+	}
+
+	assert.NoError(t, c.fetchEc2Tags(""))
+	assert.Equal(t, map[string]string{}, c.tagsCache[""].Tags["i-1"])
+	assert.Equal(t, map[string]string{"availability_zone": "us-east-1a", "env": "prod"}, c.tagsCache[""].Tags["i-2"])
+
+	// only the availability zone is kept when no key is configured
+	c.Ec2TagKeys = nil
+	c.tagsCache = nil
+	assert.NoError(t, c.fetchEc2Tags(""))
+	assert.Equal(t, map[string]string{"availability_zone": "us-east-1a"}, c.tagsCache[""].Tags["i-2"])
+}
+
+func TestGatherTagDerivations(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:        "us-east-1",
+		Namespace:     "AWS/EBS",
+		Delay:         internalDuration,
+		Period:        internalDuration,
+		RateLimit:     10,
+		EnrichEc2Tags: true,
+		Ec2TagKeys:    []string{"Name"},
+
+		Ec2TagCacheTTL: internal.Duration{Duration: time.Hour},
+		TagDerivations: []*TagDerivation{
+			&TagDerivation{
+				Source:  "Name",
+				Pattern: "^(.+)-([0-9]+)$",
+				Tags:    []string{"pool", "index"},
+			},
+			&TagDerivation{
+				Source:  "Missing",
+				Pattern: "(.*)",
+				Tags:    []string{"missing"},
+			},
+		},
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockInstanceCloudWatchClient{}}
+	c.ec2Clients = map[string]ec2Client{c.Region: &mockEc2Client{}}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	tags := map[string]string{}
+	tags["unit"] = "seconds"
+	tags["region"] = "us-east-1"
+	tags["instance_id"] = "i-2"
+	tags["availability_zone"] = "us-east-1a"
+	tags["Name"] = "db-1"
+	tags["pool"] = "db"
+	tags["index"] = "1"
+
+	assert.Equal(t, tags, acc.Metrics[0].Tags)
+}
+
+func TestTagDerivationDelimiter(t *testing.T) {
+	d := &TagDerivation{
+		Source:    "Name",
+		Delimiter: "-",
+		Tags:      []string{"team", "service", "az"},
+	}
+
+	tags := map[string]string{"Name": "ops-web-1a"}
+	d.apply(tags)
+	assert.Equal(t, map[string]string{"Name": "ops-web-1a", "team": "ops", "service": "web", "az": "1a"}, tags)
+
+	// values not following the convention are left alone
+	tags = map[string]string{"Name": "ops-web"}
+	d.apply(tags)
+	assert.Equal(t, map[string]string{"Name": "ops-web"}, tags)
+	tags = map[string]string{"Name": "ops-web-api-1a"}
+	d.apply(tags)
+	assert.Equal(t, map[string]string{"Name": "ops-web-api-1a"}, tags)
+}
+
+func TestIsEnrichedTag(t *testing.T) {
+	c := &CloudWatch{
+		EnrichEc2Tags:   true,
+		Ec2TagKeys:      []string{"env"},
+		RdsTagKeys:      []string{"Name"},
+		ResourceTagKeys: []string{"team"},
+	}
+
+	// derivations may only read the tags of enabled enrichments
+	assert.True(t, c.isEnrichedTag("env"))
+	assert.True(t, c.isEnrichedTag("availability_zone"))
+	assert.False(t, c.isEnrichedTag("Name"))
+	assert.False(t, c.isEnrichedTag("team"))
+
+	c.EnrichRdsTags = true
+	assert.True(t, c.isEnrichedTag("Name"))
+}
+
+func TestInvalidTagDerivation(t *testing.T) {
+	c := &CloudWatch{
+		TagDerivations: []*TagDerivation{
+			&TagDerivation{Source: "Name", Pattern: "(", Tags: []string{"pool"}},
+		},
+	}
+
+	assert.Error(t, c.compileTagDerivations())
+
+	c.TagDerivations = []*TagDerivation{
+		&TagDerivation{Source: "Name", Pattern: "(.*)", Delimiter: "-", Tags: []string{"pool"}},
+	}
+	assert.Error(t, c.compileTagDerivations())
+}
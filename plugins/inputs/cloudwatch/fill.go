@@ -0,0 +1,175 @@
+package cloudwatch
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// Gap filling strategies of the 'fill' option.
+const (
+	fillNone     = "none"
+	fillPrevious = "previous"
+	fillZero     = "zero"
+)
+
+// byTimestamp sorts Datapoints by timestamp.
+type byTimestamp []*cloudwatch.Datapoint
+
+func (s byTimestamp) Len() int {
+	return len(s)
+}
+
+func (s byTimestamp) Less(i, j int) bool {
+	return s[i].Timestamp.Before(*s[j].Timestamp)
+}
+
+func (s byTimestamp) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+/*
+ * Fill the period buckets of the requested timeframe that have no Datapoint
+ * according to the configured fill strategy, their counts being zero when
+ * enabled
+ */
+func (c *CloudWatch) fillDatapoints(
+	metric *SelectedMetric,
+	params *cloudwatch.GetMetricStatisticsInput,
+	datapoints []*cloudwatch.Datapoint,
+) []*cloudwatch.Datapoint {
+	noFill := c.Fill == "" || c.Fill == fillNone
+	if noFill && !c.ZeroCounts {
+		return datapoints
+	}
+
+	sort.Sort(byTimestamp(datapoints))
+
+	period := time.Duration(*params.Period) * time.Second
+	present := map[int64]bool{}
+	unit := aws.String(cloudwatch.StandardUnitNone)
+	for _, point := range datapoints {
+		present[point.Timestamp.Truncate(period).UnixNano()] = true
+		if point.Unit != nil {
+			unit = point.Unit
+		}
+	}
+
+	key := metric.key()
+	c.mu.Lock()
+	previous := c.lastDatapoints[key]
+	c.mu.Unlock()
+	if len(datapoints) == 0 && previous != nil {
+		unit = previous.Unit
+	}
+
+	filled := make([]*cloudwatch.Datapoint, 0, len(datapoints))
+	i := 0
+	for ts := params.StartTime.Truncate(period); ts.Before(*params.EndTime); ts = ts.Add(period) {
+		// keep the datapoints up to the end of the bucket
+		for ; i < len(datapoints) && datapoints[i].Timestamp.Before(ts.Add(period)); i++ {
+			filled = append(filled, c.zeroCounts(metric, datapoints[i]))
+			previous = datapoints[i]
+		}
+		if present[ts.UnixNano()] {
+			continue
+		}
+
+		var point *cloudwatch.Datapoint
+		switch c.Fill {
+		case fillZero:
+			point = c.zeroDatapoint(metric, ts, unit)
+		case fillPrevious:
+			if previous != nil {
+				repeated := *previous
+				repeated.Timestamp = aws.Time(ts)
+				if c.ZeroCounts {
+					repeated.Sum = nil
+					repeated.SampleCount = nil
+				}
+				point = &repeated
+			}
+		}
+		if point == nil && c.ZeroCounts && c.requestsCounts(metric) {
+			point = &cloudwatch.Datapoint{Timestamp: aws.Time(ts), Unit: unit}
+		}
+		if point != nil {
+			filled = append(filled, c.zeroCounts(metric, point))
+		}
+	}
+	for ; i < len(datapoints); i++ {
+		filled = append(filled, c.zeroCounts(metric, datapoints[i]))
+		previous = datapoints[i]
+	}
+
+	if previous != nil {
+		c.mu.Lock()
+		if c.lastDatapoints == nil {
+			c.lastDatapoints = map[string]*cloudwatch.Datapoint{}
+		}
+		c.lastDatapoints[key] = previous
+		c.mu.Unlock()
+	}
+	return filled
+}
+
+/*
+ * Build a Datapoint with every requested statistic of given Metric set to zero
+ */
+func (c *CloudWatch) zeroDatapoint(metric *SelectedMetric, timestamp time.Time, unit *string) *cloudwatch.Datapoint {
+	point := &cloudwatch.Datapoint{
+		Timestamp: aws.Time(timestamp),
+		Unit:      unit,
+	}
+	for _, statistic := range c.metricStatistics(metric) {
+		switch statistic {
+		case cloudwatch.StatisticAverage:
+			point.Average = aws.Float64(0)
+		case cloudwatch.StatisticMaximum:
+			point.Maximum = aws.Float64(0)
+		case cloudwatch.StatisticMinimum:
+			point.Minimum = aws.Float64(0)
+		case cloudwatch.StatisticSampleCount:
+			point.SampleCount = aws.Float64(0)
+		case cloudwatch.StatisticSum:
+			point.Sum = aws.Float64(0)
+		}
+	}
+	if extended := c.metricExtendedStatistics(metric); len(extended) > 0 {
+		point.ExtendedStatistics = make(map[string]*float64, len(extended))
+		for _, statistic := range extended {
+			point.ExtendedStatistics[statistic] = aws.Float64(0)
+		}
+	}
+	return point
+}
+
+/*
+ * Set the Sum and SampleCount statistics of given Datapoint to zero when they
+ * are requested but missing, if enabled
+ */
+func (c *CloudWatch) zeroCounts(metric *SelectedMetric, point *cloudwatch.Datapoint) *cloudwatch.Datapoint {
+	if !c.ZeroCounts {
+		return point
+	}
+	for _, statistic := range c.metricStatistics(metric) {
+		switch statistic {
+		case cloudwatch.StatisticSampleCount:
+			if point.SampleCount == nil {
+				point.SampleCount = aws.Float64(0)
+			}
+		case cloudwatch.StatisticSum:
+			if point.Sum == nil {
+				point.Sum = aws.Float64(0)
+			}
+		}
+	}
+	return point
+}
+
+func (c *CloudWatch) requestsCounts(metric *SelectedMetric) bool {
+	statistics := c.metricStatistics(metric)
+	return contains(statistics, cloudwatch.StatisticSampleCount) || contains(statistics, cloudwatch.StatisticSum)
+}
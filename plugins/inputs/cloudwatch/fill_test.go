@@ -0,0 +1,143 @@
+package cloudwatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+)
+
+func fillTestInput(start time.Time) *cloudwatch.GetMetricStatisticsInput {
+	return &cloudwatch.GetMetricStatisticsInput{
+		StartTime: aws.Time(start),
+		EndTime:   aws.Time(start.Add(3 * time.Minute)),
+		Period:    aws.Int64(60),
+	}
+}
+
+func TestFillDatapoints(t *testing.T) {
+	start := time.Unix(1500000000, 0).Truncate(time.Minute)
+	metric := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			Namespace:  aws.String("AWS/ELB"),
+			MetricName: aws.String("RequestCount"),
+		},
+		Filter: &Metric{Statistics: []string{"Sum"}},
+	}
+
+	tests := []struct {
+		fill string
+		sums []float64
+	}{
+		{fill: "none", sums: []float64{5}},
+		{fill: "zero", sums: []float64{0, 5, 0}},
+		{fill: "previous", sums: []float64{5, 5}},
+	}
+
+	for _, tt := range tests {
+		c := &CloudWatch{Fill: tt.fill}
+		datapoints := []*cloudwatch.Datapoint{
+			&cloudwatch.Datapoint{
+				Timestamp: aws.Time(start.Add(time.Minute)),
+				Sum:       aws.Float64(5),
+				Unit:      aws.String("Count"),
+			},
+		}
+
+		filled := c.fillDatapoints(metric, fillTestInput(start), datapoints)
+		sums := []float64{}
+		for _, point := range filled {
+			sums = append(sums, *point.Sum)
+			assert.Equal(t, "Count", *point.Unit)
+		}
+		assert.Equal(t, tt.sums, sums, tt.fill)
+	}
+}
+
+func TestFillDatapointsPreviousAcrossGathers(t *testing.T) {
+	start := time.Unix(1500000000, 0).Truncate(time.Minute)
+	metric := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			Namespace:  aws.String("AWS/ELB"),
+			MetricName: aws.String("RequestCount"),
+		},
+		Filter: &Metric{Statistics: []string{"Sum"}},
+	}
+	c := &CloudWatch{Fill: "previous"}
+
+	datapoints := []*cloudwatch.Datapoint{
+		&cloudwatch.Datapoint{
+			Timestamp: aws.Time(start.Add(2 * time.Minute)),
+			Sum:       aws.Float64(7),
+			Unit:      aws.String("Count"),
+		},
+	}
+	c.fillDatapoints(metric, fillTestInput(start), datapoints)
+
+	// the next window has no data and repeats the last known datapoint
+	filled := c.fillDatapoints(metric, fillTestInput(start.Add(3*time.Minute)), nil)
+	assert.Len(t, filled, 3)
+	for i, point := range filled {
+		assert.Equal(t, 7.0, *point.Sum)
+		assert.Equal(t, start.Add(time.Duration(3+i)*time.Minute), *point.Timestamp)
+	}
+}
+
+func TestFillDatapointsZeroCounts(t *testing.T) {
+	start := time.Unix(1500000000, 0).Truncate(time.Minute)
+	metric := &SelectedMetric{
+		Metric: &cloudwatch.Metric{
+			Namespace:  aws.String("AWS/ELB"),
+			MetricName: aws.String("Latency"),
+		},
+		Filter: &Metric{Statistics: []string{"Average", "Sum"}},
+	}
+
+	tests := []struct {
+		fill     string
+		sums     []float64
+		averages []float64
+	}{
+		{fill: "none", sums: []float64{0, 5, 0}, averages: []float64{2}},
+		{fill: "previous", sums: []float64{0, 5, 0}, averages: []float64{2, 2}},
+	}
+
+	for _, tt := range tests {
+		c := &CloudWatch{Fill: tt.fill, ZeroCounts: true}
+		datapoints := []*cloudwatch.Datapoint{
+			&cloudwatch.Datapoint{
+				Timestamp: aws.Time(start.Add(time.Minute)),
+				Average:   aws.Float64(2),
+				Sum:       aws.Float64(5),
+				Unit:      aws.String("Seconds"),
+			},
+		}
+
+		// the counts of the periods without datapoints are zero, while the
+		// other statistics are filled according to fill
+		filled := c.fillDatapoints(metric, fillTestInput(start), datapoints)
+		sums := []float64{}
+		averages := []float64{}
+		for _, point := range filled {
+			sums = append(sums, *point.Sum)
+			if point.Average != nil {
+				averages = append(averages, *point.Average)
+			}
+		}
+		assert.Equal(t, tt.sums, sums, tt.fill)
+		assert.Equal(t, tt.averages, averages, tt.fill)
+	}
+
+	// missing counts of datapoints are zero as well
+	c := &CloudWatch{ZeroCounts: true}
+	datapoints := []*cloudwatch.Datapoint{
+		&cloudwatch.Datapoint{
+			Timestamp: aws.Time(start),
+			Average:   aws.Float64(2),
+		},
+	}
+	filled := c.fillDatapoints(metric, fillTestInput(start), datapoints)
+	assert.Equal(t, 0.0, *filled[0].Sum)
+}
@@ -0,0 +1,104 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+type (
+	// metricCacheFile is the on-disk format of the metric listings cache,
+	// keyed by region then listing.
+	metricCacheFile struct {
+		Listings map[string]map[string]*metricCacheEntry `json:"listings"`
+	}
+
+	metricCacheEntry struct {
+		Fetched  time.Time            `json:"fetched"`
+		Metrics  []*cloudwatch.Metric `json:"metrics"`
+		Accounts []string             `json:"accounts,omitempty"`
+	}
+)
+
+/*
+ * Load the metric listings persisted in the cache file, the ones older than
+ * the cache TTL are fetched again on use
+ */
+func (c *CloudWatch) loadMetricCache() error {
+	data, err := ioutil.ReadFile(c.MetricCacheFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	file := &metricCacheFile{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.metricCache == nil {
+		c.metricCache = map[string]map[string]*MetricCache{}
+	}
+	for region, listings := range file.Listings {
+		if c.metricCache[region] == nil {
+			c.metricCache[region] = map[string]*MetricCache{}
+		}
+		for key, entry := range listings {
+			c.metricCache[region][key] = &MetricCache{
+				Metrics:  entry.Metrics,
+				Accounts: entry.Accounts,
+				Fetched:  entry.Fetched,
+				TTL:      c.CacheTTL.Duration,
+				fetched:  true,
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * Persist the metric listings to the cache file, replacing it at once so that
+ * it is never read partially written. The caller must hold c.mu.
+ */
+func (c *CloudWatch) saveMetricCache() error {
+	file := &metricCacheFile{
+		Listings: map[string]map[string]*metricCacheEntry{},
+	}
+	for region, listings := range c.metricCache {
+		file.Listings[region] = map[string]*metricCacheEntry{}
+		for key, cache := range listings {
+			file.Listings[region][key] = &metricCacheEntry{
+				Fetched:  cache.Fetched,
+				Metrics:  cache.Metrics,
+				Accounts: cache.Accounts,
+			}
+		}
+	}
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.MetricCacheFile), filepath.Base(c.MetricCacheFile))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.MetricCacheFile)
+}
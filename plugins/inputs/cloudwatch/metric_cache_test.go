@@ -0,0 +1,120 @@
+package cloudwatch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockCountingCloudWatchClient struct {
+	mockGatherCloudWatchClient
+	calls int
+}
+
+func (m *mockCountingCloudWatchClient) ListMetricsWithContext(ctx aws.Context, params *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
+	m.calls++
+	return m.mockGatherCloudWatchClient.ListMetricsWithContext(ctx, params, opts...)
+}
+
+func TestMetricCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudwatch")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "metrics.json")
+
+	newCloudWatch := func(client cloudwatchClient) *CloudWatch {
+		return &CloudWatch{
+			Region:          "us-east-1",
+			Namespaces:      []string{"AWS/ELB"},
+			CacheTTL:        internal.Duration{Duration: time.Hour},
+			RateLimit:       10,
+			MetricCacheFile: file,
+			clients:         map[string]cloudwatchClient{"us-east-1": client},
+		}
+	}
+
+	// a missing file starts with an empty cache
+	first := &mockCountingCloudWatchClient{}
+	c := newCloudWatch(first)
+	assert.NoError(t, c.loadMetricCache())
+	metrics, err := c.fetchNamespaceMetrics(nil)
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, 1, first.calls)
+
+	// listings are restored from the file after a restart
+	second := &mockCountingCloudWatchClient{}
+	c = newCloudWatch(second)
+	assert.NoError(t, c.loadMetricCache())
+	restored, err := c.fetchNamespaceMetrics(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, metrics, restored)
+	assert.Equal(t, 0, second.calls)
+
+	// and listed again once older than the TTL
+	c = newCloudWatch(second)
+	c.CacheTTL = internal.Duration{Duration: time.Nanosecond}
+	assert.NoError(t, c.loadMetricCache())
+	_, err = c.fetchNamespaceMetrics(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, second.calls)
+}
+
+func TestMetricCacheFileOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudwatch")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "metrics.json")
+
+	newCloudWatch := func(client cloudwatchClient) *CloudWatch {
+		return &CloudWatch{
+			Region:          "us-east-1",
+			Namespaces:      []string{"AWS/ELB"},
+			CacheTTL:        internal.Duration{Duration: time.Hour},
+			RateLimit:       10,
+			MetricCacheFile: file,
+			clients:         map[string]cloudwatchClient{"us-east-1": client},
+		}
+	}
+
+	first := &mockCountingCloudWatchClient{}
+	c := newCloudWatch(first)
+	assert.NoError(t, c.loadMetricCache())
+	_, err = c.fetchNamespaceMetrics(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, first.calls)
+
+	// a listing persisted before changing the options listing metrics is not
+	// restored
+	for _, option := range []func(*CloudWatch){
+		func(c *CloudWatch) { c.RecentlyActive = true },
+		func(c *CloudWatch) { c.LinkedAccounts = true },
+	} {
+		next := &mockCountingCloudWatchClient{}
+		c = newCloudWatch(next)
+		option(c)
+		assert.NoError(t, c.loadMetricCache())
+		_, err = c.fetchNamespaceMetrics(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, next.calls)
+	}
+}
+
+func TestMetricCacheFileInvalid(t *testing.T) {
+	f, err := ioutil.TempFile("", "cloudwatch")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("{")
+	f.Close()
+
+	c := &CloudWatch{MetricCacheFile: f.Name()}
+	assert.Error(t, c.loadMetricCache())
+}
@@ -0,0 +1,184 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+)
+
+// metricMathMeasurement is the measurement suffix of metric math results.
+const metricMathMeasurement = "metric_math"
+
+// metricMathIDRegexp matches the query ids accepted by GetMetricData.
+var metricMathIDRegexp = regexp.MustCompile(`^[a-z][a-zA-Z0-9_]*$`)
+
+// MetricMath is a metric math expression evaluated by CloudWatch through
+// GetMetricData. Its results are emitted as the field named after Label, or
+// ID when no label is set.
+type MetricMath struct {
+	ID         string            `toml:"id"`
+	Expression string            `toml:"expression"`
+	Label      string            `toml:"label"`
+	Period     internal.Duration `toml:"period"`
+}
+
+/*
+ * Check the configured metric math expressions
+ */
+func (c *CloudWatch) checkMetricMath() error {
+	if len(c.MetricMath) == 0 {
+		return nil
+	}
+	if !c.UseGetMetricData {
+		return fmt.Errorf("metric_math requires use_get_metric_data")
+	}
+	if len(c.MetricMath) > maxMetricDataQueries {
+		return fmt.Errorf("at most %d metric_math expressions are allowed, got %d", maxMetricDataQueries, len(c.MetricMath))
+	}
+
+	ids := map[string]bool{}
+	for _, m := range c.MetricMath {
+		if !metricMathIDRegexp.MatchString(m.ID) {
+			return fmt.Errorf("invalid metric_math id %q, must start with a lowercase letter followed by letters, digits or underscores", m.ID)
+		}
+		if ids[m.ID] {
+			return fmt.Errorf("duplicate metric_math id %q", m.ID)
+		}
+		ids[m.ID] = true
+
+		if m.Expression == "" {
+			return fmt.Errorf("metric_math %q has no expression", m.ID)
+		}
+		if m.Period.Duration != 0 {
+			if err := checkPeriod("metric_math period", m.Period.Duration, c.HighResolution); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * Build the GetMetricData request of the metric math expressions, sent as a
+ * single request so that expressions may refer to each other
+ */
+func (c *CloudWatch) getMetricMathInput(now time.Time) *cloudwatch.GetMetricDataInput {
+	end := now.Add(-c.Delay.Duration)
+	longest := c.Period.Duration
+
+	params := &cloudwatch.GetMetricDataInput{
+		EndTime:           aws.Time(end),
+		MetricDataQueries: make([]*cloudwatch.MetricDataQuery, 0, len(c.MetricMath)),
+	}
+	for _, m := range c.MetricMath {
+		period := c.Period.Duration
+		if m.Period.Duration > 0 {
+			period = m.Period.Duration
+		}
+		if period > longest {
+			longest = period
+		}
+
+		params.MetricDataQueries = append(params.MetricDataQueries, &cloudwatch.MetricDataQuery{
+			Id:         aws.String(m.ID),
+			Expression: aws.String(m.Expression),
+			Label:      aws.String(m.label()),
+			Period:     aws.Int64(int64(period.Seconds())),
+		})
+	}
+	params.StartTime = aws.Time(end.Add(-longest))
+	return params
+}
+
+/*
+ * Gather the metric math expressions of given region and emit any error,
+ * waiting for a token of the rate limiter before each request
+ */
+func (c *CloudWatch) gatherMetricMath(
+	acc telegraf.Accumulator,
+	region string,
+	now time.Time,
+	tokens <-chan bool,
+	errChan chan error,
+) {
+	labels := map[string]string{}
+	for _, m := range c.MetricMath {
+		labels[m.ID] = m.label()
+	}
+
+	// collect the fields of every expression per timestamp
+	points := map[time.Time]map[string]interface{}{}
+	params := c.getMetricMathInput(now)
+	for more := true; more; {
+		<-tokens
+		ctx, cancel := c.requestContext()
+		resp, err := c.clients[region].GetMetricDataWithContext(ctx, params)
+		cancel()
+		c.countAPICall(region, metricMathMeasurement, err)
+		c.checkCredentials(err)
+		if err != nil {
+			errChan <- fmt.Errorf("metric math of region %s failed to be evaluated: %s", region, err)
+			return
+		}
+
+		for _, result := range resp.MetricDataResults {
+			label, ok := labels[aws.StringValue(result.Id)]
+			if !ok {
+				continue
+			}
+			for i, timestamp := range result.Timestamps {
+				if i >= len(result.Values) {
+					break
+				}
+				fields, ok := points[*timestamp]
+				if !ok {
+					fields = map[string]interface{}{}
+					points[*timestamp] = fields
+				}
+				fields[label] = *result.Values[i]
+			}
+		}
+
+		params.NextToken = resp.NextToken
+		more = resp.NextToken != nil
+	}
+
+	for timestamp, fields := range points {
+		tags := map[string]string{}
+		if !c.OmitRegionTag {
+			tags["region"] = region
+		}
+		if c.accountID != "" {
+			tags["account_id"] = c.accountID
+		}
+		acc.AddFields(c.metricMathMeasurementName(), fields, tags, timestamp)
+	}
+
+	errChan <- nil
+}
+
+/*
+ * Resolve the measurement name of metric math results
+ */
+func (c *CloudWatch) metricMathMeasurementName() string {
+	if c.Measurement != "" {
+		return c.Measurement
+	}
+	if c.MeasurementPrefix != "" {
+		return c.MeasurementPrefix + metricMathMeasurement
+	}
+	return formatMeasurement(metricMathMeasurement)
+}
+
+func (m *MetricMath) label() string {
+	if m.Label != "" {
+		return m.Label
+	}
+	return m.ID
+}
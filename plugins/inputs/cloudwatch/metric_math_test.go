@@ -0,0 +1,201 @@
+package cloudwatch
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockMetricMathCloudWatchClient struct {
+	mockGatherCloudWatchClient
+	requests []*cloudwatch.GetMetricDataInput
+}
+
+func (m *mockMetricMathCloudWatchClient) GetMetricDataWithContext(ctx aws.Context, params *cloudwatch.GetMetricDataInput, opts ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	if params.MetricDataQueries[0].Expression == nil {
+		return m.mockGatherCloudWatchClient.GetMetricDataWithContext(ctx, params, opts...)
+	}
+
+	m.requests = append(m.requests, params)
+	result := &cloudwatch.GetMetricDataOutput{}
+	for i, q := range params.MetricDataQueries {
+		result.MetricDataResults = append(result.MetricDataResults, &cloudwatch.MetricDataResult{
+			Id:         q.Id,
+			Label:      q.Label,
+			Timestamps: []*time.Time{params.EndTime},
+			Values:     []*float64{aws.Float64(float64(i + 1))},
+		})
+	}
+	return result, nil
+}
+
+func TestGatherMetricMath(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:           "us-east-1",
+		Namespace:        "AWS/ELB",
+		Delay:            internalDuration,
+		Period:           internalDuration,
+		RateLimit:        10,
+		UseGetMetricData: true,
+		MetricMath: []*MetricMath{
+			&MetricMath{ID: "errors", Expression: "SUM(SEARCH('{AWS/ELB,LoadBalancerName} MetricName=HTTPCode_Backend_4XX', 'Sum', 300))"},
+			&MetricMath{
+				ID:         "error_rate",
+				Expression: "100 * errors / requests",
+				Label:      "error_rate_percent",
+				Period:     internal.Duration{Duration: 5 * time.Minute},
+			},
+		},
+	}
+
+	var acc testutil.Accumulator
+	client := &mockMetricMathCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: client}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	// expressions are sent in a single request covering the longest period
+	assert.Len(t, client.requests, 1)
+	params := client.requests[0]
+	assert.Equal(t, 5*time.Minute, params.EndTime.Sub(*params.StartTime))
+	assert.Equal(t, "errors", *params.MetricDataQueries[0].Label)
+	assert.EqualValues(t, 60, *params.MetricDataQueries[0].Period)
+	assert.EqualValues(t, 300, *params.MetricDataQueries[1].Period)
+
+	fields := map[string]interface{}{}
+	fields["errors"] = 1.0
+	fields["error_rate_percent"] = 2.0
+
+	tags := map[string]string{}
+	tags["region"] = "us-east-1"
+
+	acc.AssertContainsTaggedFields(t, "cloudwatch_metric_math", fields, tags)
+	assert.True(t, acc.HasMeasurement("cloudwatch_aws_elb"))
+}
+
+type mockFailingMetricMathCloudWatchClient struct {
+	mockGatherCloudWatchClient
+	failMetrics bool
+}
+
+func (m *mockFailingMetricMathCloudWatchClient) GetMetricDataWithContext(ctx aws.Context, params *cloudwatch.GetMetricDataInput, opts ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	if params.MetricDataQueries[0].Expression == nil && !m.failMetrics {
+		return m.mockGatherCloudWatchClient.GetMetricDataWithContext(ctx, params, opts...)
+	}
+	return nil, errors.New("throttled")
+}
+
+func TestGatherMetricMathErrors(t *testing.T) {
+	c := &CloudWatch{
+		Region:           "us-east-1",
+		Namespace:        "AWS/ELB",
+		Period:           internal.Duration{Duration: time.Minute},
+		RateLimit:        10,
+		UseGetMetricData: true,
+		MetricMath: []*MetricMath{
+			&MetricMath{ID: "errors", Expression: "SUM(SEARCH('{AWS/ELB,LoadBalancerName} MetricName=HTTPCode_Backend_4XX', 'Sum', 300))"},
+		},
+	}
+
+	// a failed expression is not counted as a failed metric
+	var acc testutil.Accumulator
+	client := &mockFailingMetricMathCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: client}
+	assert.EqualError(t, c.Gather(&acc), "metric math of region us-east-1 failed to be evaluated: throttled")
+	assert.True(t, acc.HasMeasurement("cloudwatch_aws_elb"))
+
+	// but reported along with the failed metrics
+	acc = testutil.Accumulator{}
+	client.failMetrics = true
+	assert.EqualError(t, c.Gather(&acc), "1 of 1 metrics failed to be gathered: [throttled]; metric math of region us-east-1 failed to be evaluated: throttled")
+	assert.Len(t, acc.Metrics, 0)
+}
+
+func TestGatherMetricMathExpiredCredentials(t *testing.T) {
+	c := &CloudWatch{
+		Region:           "us-east-1",
+		Period:           internal.Duration{Duration: time.Minute},
+		RateLimit:        10,
+		UseGetMetricData: true,
+		MetricMath: []*MetricMath{
+			&MetricMath{ID: "errors", Expression: "SUM(SEARCH('{AWS/ELB,LoadBalancerName} MetricName=HTTPCode_Backend_4XX', 'Sum', 300))"},
+		},
+	}
+
+	errChan := make(chan error, 1)
+	tokens := make(chan bool, 1)
+	tokens <- true
+	c.SetClientFuncs(c.Region, &ClientFuncs{
+		GetMetricData: func(ctx context.Context, params *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			return nil, awserr.New("ExpiredToken", "The security token included in the request is expired", nil)
+		},
+	})
+
+	// the credentials are renewed after expiring for metric math requests too
+	var acc testutil.Accumulator
+	c.gatherMetricMath(&acc, c.Region, time.Now(), tokens, errChan)
+	assert.Error(t, <-errChan)
+	assert.True(t, c.credentialsExpired)
+}
+
+func TestCheckMetricMath(t *testing.T) {
+	tests := []struct {
+		name  string
+		math  []*MetricMath
+		valid bool
+	}{
+		{
+			name:  "valid",
+			math:  []*MetricMath{&MetricMath{ID: "e1", Expression: "m1 / m2"}},
+			valid: true,
+		},
+		{
+			name: "invalid id",
+			math: []*MetricMath{&MetricMath{ID: "ErrorRate", Expression: "m1 / m2"}},
+		},
+		{
+			name: "duplicate id",
+			math: []*MetricMath{
+				&MetricMath{ID: "e1", Expression: "m1 / m2"},
+				&MetricMath{ID: "e1", Expression: "m1 * m2"},
+			},
+		},
+		{
+			name: "missing expression",
+			math: []*MetricMath{&MetricMath{ID: "e1"}},
+		},
+		{
+			name: "invalid period",
+			math: []*MetricMath{
+				&MetricMath{ID: "e1", Expression: "m1 / m2", Period: internal.Duration{Duration: 90 * time.Second}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		c := &CloudWatch{UseGetMetricData: true, MetricMath: tt.math}
+		err := c.checkMetricMath()
+		if tt.valid {
+			assert.NoError(t, err, tt.name)
+		} else {
+			assert.Error(t, err, tt.name)
+		}
+	}
+
+	// metric math is only available through GetMetricData
+	c := &CloudWatch{MetricMath: []*MetricMath{&MetricMath{ID: "e1", Expression: "m1 / m2"}}}
+	assert.Error(t, c.checkMetricMath())
+}
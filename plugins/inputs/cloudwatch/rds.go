@@ -0,0 +1,84 @@
+package cloudwatch
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+const (
+	// rdsNamespace is the namespace of RDS metrics.
+	rdsNamespace = "AWS/RDS"
+
+	// dbInstanceIDDimension is the dimension name identifying RDS instances.
+	dbInstanceIDDimension = "DBInstanceIdentifier"
+)
+
+type rdsClient interface {
+	DescribeDBInstancesWithContext(aws.Context, *rds.DescribeDBInstancesInput, ...request.Option) (*rds.DescribeDBInstancesOutput, error)
+}
+
+/*
+ * Fetch the configured tags of every RDS instance in given region, which are
+ * included in the DescribeDBInstances results so that no ListTagsForResource
+ * request is needed per instance
+ */
+func (c *CloudWatch) fetchRdsTags(region string) error {
+	cache := c.rdsTagsCache[region]
+	if cache != nil && cache.IsValid() {
+		return nil
+	}
+
+	now := time.Now()
+	tags := map[string]map[string]string{}
+	seen := map[string]time.Time{}
+
+	params := &rds.DescribeDBInstancesInput{}
+	for more := true; more; {
+		ctx, cancel := c.requestContext()
+		resp, err := c.rdsClients[region].DescribeDBInstancesWithContext(ctx, params)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		for _, instance := range resp.DBInstances {
+			if instance.DBInstanceIdentifier == nil {
+				continue
+			}
+			instanceTags := map[string]string{}
+			for _, tag := range instance.TagList {
+				if contains(c.RdsTagKeys, aws.StringValue(tag.Key)) {
+					instanceTags[*tag.Key] = aws.StringValue(tag.Value)
+				}
+			}
+			tags[*instance.DBInstanceIdentifier] = instanceTags
+			seen[*instance.DBInstanceIdentifier] = now
+		}
+
+		params.Marker = resp.Marker
+		more = resp.Marker != nil
+	}
+
+	if c.rdsTagsCache == nil {
+		c.rdsTagsCache = map[string]*TagCache{}
+	}
+	c.rdsTagsCache[region] = c.newTagCache(cache, dbInstanceIDDimension, tags, seen, now)
+
+	return nil
+}
+
+/*
+ * Add the RDS tags of the instance identified by the DBInstanceIdentifier
+ * dimension of given RDS Metric, if any
+ */
+func (c *CloudWatch) addRdsTags(metric *SelectedMetric, tags map[string]string) {
+	cache := c.rdsTagsCache[metric.Region]
+	if cache == nil || aws.StringValue(metric.Namespace) != rdsNamespace {
+		return
+	}
+
+	c.copyTags(tags, cache.dimensionTags(metric.Dimensions))
+}
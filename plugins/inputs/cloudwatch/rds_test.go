@@ -0,0 +1,130 @@
+package cloudwatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockDBInstanceCloudWatchClient struct {
+	mockGatherCloudWatchClient
+}
+
+func (m *mockDBInstanceCloudWatchClient) ListMetricsWithContext(ctx aws.Context, params *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
+	metric := &cloudwatch.Metric{
+		Namespace:  params.Namespace,
+		MetricName: aws.String("CPUUtilization"),
+		Dimensions: []*cloudwatch.Dimension{
+			&cloudwatch.Dimension{
+				Name:  aws.String("DBInstanceIdentifier"),
+				Value: aws.String("orders"),
+			},
+		},
+	}
+
+	result := &cloudwatch.ListMetricsOutput{
+		Metrics: []*cloudwatch.Metric{metric},
+	}
+	return result, nil
+}
+
+type mockRdsClient struct {
+	calls int
+}
+
+func (m *mockRdsClient) DescribeDBInstancesWithContext(ctx aws.Context, params *rds.DescribeDBInstancesInput, opts ...request.Option) (*rds.DescribeDBInstancesOutput, error) {
+	m.calls++
+
+	// return one instance per page
+	if params.Marker == nil {
+		return &rds.DescribeDBInstancesOutput{
+			Marker: aws.String("page-2"),
+			DBInstances: []*rds.DBInstance{
+				&rds.DBInstance{
+					DBInstanceIdentifier: aws.String("orders"),
+					TagList: []*rds.Tag{
+						&rds.Tag{Key: aws.String("Name"), Value: aws.String("orders-db")},
+						&rds.Tag{Key: aws.String("env"), Value: aws.String("prod")},
+					},
+				},
+			},
+		}, nil
+	}
+
+	return &rds.DescribeDBInstancesOutput{
+		DBInstances: []*rds.DBInstance{
+			&rds.DBInstance{
+				DBInstanceIdentifier: aws.String("users"),
+				TagList: []*rds.Tag{
+					&rds.Tag{Key: aws.String("Name"), Value: aws.String("users-db")},
+				},
+			},
+		},
+	}, nil
+}
+
+func TestFetchRdsTags(t *testing.T) {
+	client := &mockRdsClient{}
+	c := &CloudWatch{
+		RdsTagKeys:            []string{"Name"},
+		Ec2TagCacheTTL:        internal.Duration{Duration: time.Hour},
+		Ec2TagRefreshInterval: internal.Duration{Duration: time.Hour},
+		rdsClients:            map[string]rdsClient{"": client},
+	}
+
+	assert.NoError(t, c.fetchRdsTags(""))
+	assert.Equal(t, 2, client.calls)
+	assert.Equal(t, map[string]string{"Name": "orders-db"}, c.rdsTagsCache[""].Tags["orders"])
+	assert.Equal(t, map[string]string{"Name": "users-db"}, c.rdsTagsCache[""].Tags["users"])
+
+	// cached tags are not fetched again
+	assert.NoError(t, c.fetchRdsTags(""))
+	assert.Equal(t, 2, client.calls)
+}
+
+func TestGatherEnrichRdsTags(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+
+	for _, namespace := range []string{"AWS/RDS", "Custom/RDS"} {
+		c := &CloudWatch{
+			Region:        "us-east-1",
+			Namespace:     namespace,
+			Delay:         internalDuration,
+			Period:        internalDuration,
+			RateLimit:     10,
+			EnrichRdsTags: true,
+			RdsTagKeys:    []string{"Name", "env"},
+
+			Ec2TagCacheTTL: internal.Duration{Duration: time.Hour},
+		}
+
+		var acc testutil.Accumulator
+		c.clients = map[string]cloudwatchClient{c.Region: &mockDBInstanceCloudWatchClient{}}
+		c.rdsClients = map[string]rdsClient{c.Region: &mockRdsClient{}}
+
+		assert.NoError(t, c.Gather(&acc))
+
+		tags := map[string]string{}
+		tags["unit"] = "seconds"
+		tags["region"] = "us-east-1"
+		tags["db_instance_identifier"] = "orders"
+
+		// only RDS metrics are enriched
+		if namespace == rdsNamespace {
+			tags["Name"] = "orders-db"
+			tags["env"] = "prod"
+		}
+
+		assert.Equal(t, tags, acc.Metrics[0].Tags, namespace)
+	}
+}
@@ -0,0 +1,309 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+)
+
+// resourceDimensions maps the service and resource type of an ARN to the
+// dimension identifying the resource in CloudWatch metrics.
+var resourceDimensions = map[string]string{
+	"dynamodb:table":  "TableName",
+	"ec2:instance":    "InstanceId",
+	"ec2:volume":      "VolumeId",
+	"lambda:function": "FunctionName",
+	"rds:cluster":     "DBClusterIdentifier",
+	"rds:db":          "DBInstanceIdentifier",
+	"sns:":            "TopicName",
+	"sqs:":            "QueueName",
+}
+
+type (
+	// ResourceTagFilter selects the resources having the tag Key, with one
+	// of Values when set.
+	ResourceTagFilter struct {
+		Key    string   `toml:"key"`
+		Values []string `toml:"values"`
+	}
+
+	// taggedResources are the "name=value" dimensions identifying the
+	// resources matching the resource tag filters in metrics, along with
+	// their ARN.
+	taggedResources struct {
+		fetched    time.Time
+		dimensions map[string]bool
+		arns       map[string]bool
+	}
+
+	resourceTagsClient interface {
+		GetResourcesWithContext(aws.Context, *resourcegroupstaggingapi.GetResourcesInput, ...request.Option) (*resourcegroupstaggingapi.GetResourcesOutput, error)
+	}
+)
+
+/*
+ * Fetch the configured tags of every resource in given region through the
+ * Resource Groups Tagging API
+ */
+func (c *CloudWatch) fetchResourceTags(region string) error {
+	cache := c.resourceTagsCache[region]
+	if cache != nil && cache.IsValid() {
+		return nil
+	}
+
+	now := time.Now()
+	tags := map[string]map[string]string{}
+	seen := map[string]time.Time{}
+
+	params := &resourcegroupstaggingapi.GetResourcesInput{
+		ResourceTypeFilters: aws.StringSlice(c.ResourceTypeFilters),
+	}
+	for more := true; more; {
+		ctx, cancel := c.requestContext()
+		resp, err := c.resourceTagsClients[region].GetResourcesWithContext(ctx, params)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		for _, mapping := range resp.ResourceTagMappingList {
+			if mapping.ResourceARN == nil {
+				continue
+			}
+			resourceTags := map[string]string{}
+			for _, tag := range mapping.Tags {
+				if contains(c.ResourceTagKeys, aws.StringValue(tag.Key)) {
+					resourceTags[*tag.Key] = aws.StringValue(tag.Value)
+				}
+			}
+			tags[*mapping.ResourceARN] = resourceTags
+			seen[*mapping.ResourceARN] = now
+		}
+
+		// the last page has an empty pagination token
+		params.PaginationToken = resp.PaginationToken
+		more = aws.StringValue(resp.PaginationToken) != ""
+	}
+
+	if c.resourceTagsCache == nil {
+		c.resourceTagsCache = map[string]*TagCache{}
+	}
+	cache = c.newTagCache(cache, "", tags, seen, now)
+
+	// index the resources by the dimension identifying them in metrics
+	cache.resources = map[string]string{}
+	for resourceARN := range cache.Tags {
+		if name, value, ok := resourceDimension(resourceARN); ok {
+			cache.resources[name+"="+value] = resourceARN
+		}
+	}
+	c.resourceTagsCache[region] = cache
+
+	return nil
+}
+
+/*
+ * Add the tags of the resources identified by the dimensions of given Metric,
+ * if any
+ */
+func (c *CloudWatch) addResourceTags(metric *SelectedMetric, tags map[string]string) {
+	cache := c.resourceTagsCache[metric.Region]
+	if cache == nil {
+		return
+	}
+
+	for _, d := range metric.Dimensions {
+		resourceARN, ok := cache.resources[aws.StringValue(d.Name)+"="+aws.StringValue(d.Value)]
+		if !ok {
+			continue
+		}
+		c.copyTags(tags, cache.get(resourceARN))
+	}
+
+	// the resource of the ARN of the filter, if any
+	if metric.Filter != nil && metric.Filter.ARN != "" {
+		c.copyTags(tags, cache.get(metric.Filter.ARN))
+	}
+}
+
+/*
+ * Add the dimension identifying the resource of the ARN of a Metric filter to
+ * its dimensions, restricting it to the region of the resource
+ */
+func (m *Metric) resolveARN() error {
+	if m.ARN == "" {
+		return nil
+	}
+	name, value, ok := resourceDimension(m.ARN)
+	if !ok {
+		return fmt.Errorf("unsupported metric arn %q, no dimension identifies its resource", m.ARN)
+	}
+	a, _ := arn.Parse(m.ARN)
+	m.arnRegion = a.Region
+
+	for _, d := range m.Dimensions {
+		if d.Name != name {
+			continue
+		}
+		if d.Value != value {
+			return fmt.Errorf("metric arn %q conflicts with dimension %s value %q", m.ARN, d.Name, d.Value)
+		}
+		return nil
+	}
+	m.Dimensions = append(m.Dimensions, &Dimension{Name: name, Value: value})
+	return nil
+}
+
+/*
+ * Resolve the dimension name and value identifying the resource of given ARN
+ * in CloudWatch metrics
+ */
+func resourceDimension(resourceARN string) (string, string, bool) {
+	a, err := arn.Parse(resourceARN)
+	if err != nil {
+		return "", "", false
+	}
+
+	// the resource is either "type/id", "type:id" or only the id
+	resourceType, id := "", a.Resource
+	if i := strings.IndexAny(a.Resource, "/:"); i >= 0 {
+		resourceType, id = a.Resource[:i], a.Resource[i+1:]
+	}
+
+	// application and network load balancers are identified by
+	// "app/name/id", classic ones by their name only
+	if a.Service == "elasticloadbalancing" && resourceType == "loadbalancer" {
+		if strings.Contains(id, "/") {
+			return "LoadBalancer", id, true
+		}
+		return "LoadBalancerName", id, true
+	}
+
+	// target groups are identified by "targetgroup/name/id"
+	if a.Service == "elasticloadbalancing" && resourceType == "targetgroup" {
+		return "TargetGroup", a.Resource, true
+	}
+
+	name, ok := resourceDimensions[a.Service+":"+resourceType]
+	return name, id, ok
+}
+
+/*
+ * Check the configured resource tag filters
+ */
+func (c *CloudWatch) checkResourceTagFilters() error {
+	for _, f := range c.ResourceTagFilters {
+		if f.Key == "" {
+			return fmt.Errorf("resource_tag_filters require a key")
+		}
+	}
+	return nil
+}
+
+/*
+ * Keep the Metrics of the resources matching the resource tag filters, i.e.
+ * having a dimension identifying such a resource or selected by its ARN
+ */
+func (c *CloudWatch) selectTaggedMetrics(metrics []*SelectedMetric) ([]*SelectedMetric, error) {
+	if len(c.ResourceTagFilters) == 0 {
+		return metrics, nil
+	}
+
+	// fetch the resources of each region once, even when a refresh fails
+	fetched := map[string]*taggedResources{}
+	kept := make([]*SelectedMetric, 0, len(metrics))
+	for _, metric := range metrics {
+		resources, ok := fetched[metric.Region]
+		if !ok {
+			var err error
+			resources, err = c.fetchTaggedResources(metric.Region)
+			if err != nil {
+				return nil, err
+			}
+			fetched[metric.Region] = resources
+		}
+		if resources.selects(metric) {
+			kept = append(kept, metric)
+		}
+	}
+	return kept, nil
+}
+
+/*
+ * Fetch the resources of given region matching the resource tag filters
+ * through the Resource Groups Tagging API, refreshed as resource tags are.
+ * The resources fetched before are kept when refreshing them fails.
+ */
+func (c *CloudWatch) fetchTaggedResources(region string) (*taggedResources, error) {
+	previous, ok := c.taggedResources[region]
+	if ok && time.Since(previous.fetched) < c.Ec2TagRefreshInterval.Duration {
+		return previous, nil
+	}
+
+	resources := &taggedResources{
+		fetched:    time.Now(),
+		dimensions: map[string]bool{},
+		arns:       map[string]bool{},
+	}
+	params := &resourcegroupstaggingapi.GetResourcesInput{
+		ResourceTypeFilters: aws.StringSlice(c.ResourceTypeFilters),
+	}
+	for _, f := range c.ResourceTagFilters {
+		params.TagFilters = append(params.TagFilters, &resourcegroupstaggingapi.TagFilter{
+			Key:    aws.String(f.Key),
+			Values: aws.StringSlice(f.Values),
+		})
+	}
+	for more := true; more; {
+		ctx, cancel := c.requestContext()
+		resp, err := c.resourceTagsClients[region].GetResourcesWithContext(ctx, params)
+		cancel()
+		if err != nil {
+			if ok {
+				log.Printf("W! Error fetching the resources matching resource_tag_filters in region %s, using the resources fetched %s ago: %s",
+					region, time.Since(previous.fetched), err)
+				return previous, nil
+			}
+			return nil, fmt.Errorf("failed to fetch the resources matching resource_tag_filters in region %s: %s", region, err)
+		}
+
+		for _, mapping := range resp.ResourceTagMappingList {
+			resourceARN := aws.StringValue(mapping.ResourceARN)
+			if resourceARN == "" {
+				continue
+			}
+			resources.arns[resourceARN] = true
+			if name, value, ok := resourceDimension(resourceARN); ok {
+				resources.dimensions[name+"="+value] = true
+			}
+		}
+
+		// the last page has an empty pagination token
+		params.PaginationToken = resp.PaginationToken
+		more = aws.StringValue(resp.PaginationToken) != ""
+	}
+
+	if c.taggedResources == nil {
+		c.taggedResources = map[string]*taggedResources{}
+	}
+	c.taggedResources[region] = resources
+	return resources, nil
+}
+
+func (r *taggedResources) selects(metric *SelectedMetric) bool {
+	if metric.Filter != nil && metric.Filter.ARN != "" && r.arns[metric.Filter.ARN] {
+		return true
+	}
+	for _, d := range metric.Dimensions {
+		if r.dimensions[aws.StringValue(d.Name)+"="+aws.StringValue(d.Value)] {
+			return true
+		}
+	}
+	return false
+}
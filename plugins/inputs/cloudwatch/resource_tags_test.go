@@ -0,0 +1,320 @@
+package cloudwatch
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockResourceTagsClient struct {
+	calls      int
+	filters    []*string
+	tagFilters []*resourcegroupstaggingapi.TagFilter
+}
+
+func (m *mockResourceTagsClient) GetResourcesWithContext(ctx aws.Context, params *resourcegroupstaggingapi.GetResourcesInput, opts ...request.Option) (*resourcegroupstaggingapi.GetResourcesOutput, error) {
+	m.calls++
+	m.filters = params.ResourceTypeFilters
+	m.tagFilters = params.TagFilters
+
+	// return one resource per page, the last page having an empty token
+	if params.PaginationToken == nil {
+		return &resourcegroupstaggingapi.GetResourcesOutput{
+			PaginationToken: aws.String("page-2"),
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				&resourcegroupstaggingapi.ResourceTagMapping{
+					ResourceARN: aws.String("arn:aws:ec2:us-east-1:123456789012:instance/i-2"),
+					Tags: []*resourcegroupstaggingapi.Tag{
+						&resourcegroupstaggingapi.Tag{Key: aws.String("Name"), Value: aws.String("db-1")},
+						&resourcegroupstaggingapi.Tag{Key: aws.String("env"), Value: aws.String("prod")},
+					},
+				},
+			},
+		}, nil
+	}
+
+	return &resourcegroupstaggingapi.GetResourcesOutput{
+		PaginationToken: aws.String(""),
+		ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+			&resourcegroupstaggingapi.ResourceTagMapping{
+				ResourceARN: aws.String("arn:aws:rds:us-east-1:123456789012:db:orders"),
+				Tags: []*resourcegroupstaggingapi.Tag{
+					&resourcegroupstaggingapi.Tag{Key: aws.String("Name"), Value: aws.String("orders")},
+				},
+			},
+		},
+	}, nil
+}
+
+func TestFetchResourceTags(t *testing.T) {
+	client := &mockResourceTagsClient{}
+	c := &CloudWatch{
+		ResourceTagKeys:       []string{"Name"},
+		ResourceTypeFilters:   []string{"ec2:instance", "rds:db"},
+		Ec2TagCacheTTL:        internal.Duration{Duration: time.Hour},
+		Ec2TagRefreshInterval: internal.Duration{Duration: time.Hour},
+		resourceTagsClients:   map[string]resourceTagsClient{"": client},
+	}
+
+	assert.NoError(t, c.fetchResourceTags(""))
+	assert.Equal(t, 2, client.calls)
+	assert.Equal(t, aws.StringSlice([]string{"ec2:instance", "rds:db"}), client.filters)
+
+	cache := c.resourceTagsCache[""]
+	assert.Equal(t, map[string]string{"Name": "db-1"}, cache.Tags["arn:aws:ec2:us-east-1:123456789012:instance/i-2"])
+	assert.Equal(t, "arn:aws:rds:us-east-1:123456789012:db:orders", cache.resources["DBInstanceIdentifier=orders"])
+
+	// cached tags are not fetched again
+	assert.NoError(t, c.fetchResourceTags(""))
+	assert.Equal(t, 2, client.calls)
+}
+
+func TestGatherEnrichResourceTags(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:             "us-east-1",
+		Namespace:          "AWS/EBS",
+		Delay:              internalDuration,
+		Period:             internalDuration,
+		RateLimit:          10,
+		EnrichResourceTags: true,
+		ResourceTagKeys:    []string{"Name", "env"},
+
+		Ec2TagCacheTTL: internal.Duration{Duration: time.Hour},
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockInstanceCloudWatchClient{}}
+	c.resourceTagsClients = map[string]resourceTagsClient{c.Region: &mockResourceTagsClient{}}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	tags := map[string]string{}
+	tags["unit"] = "seconds"
+	tags["region"] = "us-east-1"
+	tags["instance_id"] = "i-2"
+	tags["Name"] = "db-1"
+	tags["env"] = "prod"
+
+	assert.Equal(t, tags, acc.Metrics[0].Tags)
+}
+
+func TestGatherMetricARN(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:             "us-east-1",
+		Regions:            []string{"us-west-2"},
+		Namespace:          "AWS/RDS",
+		Delay:              internalDuration,
+		Period:             internalDuration,
+		RateLimit:          10,
+		EnrichResourceTags: true,
+		ResourceTagKeys:    []string{"Name"},
+		Metrics: []*Metric{
+			&Metric{
+				MetricNames: []string{"CPUUtilization"},
+				ARN:         "arn:aws:rds:us-east-1:123456789012:db:orders",
+			},
+		},
+
+		Ec2TagCacheTTL: internal.Duration{Duration: time.Hour},
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{
+		"us-east-1": &mockGatherCloudWatchClient{},
+		"us-west-2": &mockGatherCloudWatchClient{},
+	}
+	c.resourceTagsClients = map[string]resourceTagsClient{
+		"us-east-1": &mockResourceTagsClient{},
+		"us-west-2": &mockResourceTagsClient{},
+	}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	// only the metric of the region of the resource is pulled
+	assert.Len(t, acc.Metrics, 1)
+
+	tags := map[string]string{}
+	tags["unit"] = "seconds"
+	tags["region"] = "us-east-1"
+	tags["db_instance_identifier"] = "orders"
+	tags["Name"] = "orders"
+
+	assert.Equal(t, tags, acc.Metrics[0].Tags)
+}
+
+func TestSelectMetricsResourceTagFilters(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/EC2",
+		RateLimit: 10,
+		ResourceTagFilters: []*ResourceTagFilter{
+			&ResourceTagFilter{Key: "env", Values: []string{"prod"}},
+		},
+		Ec2TagRefreshInterval: internal.Duration{Duration: time.Hour},
+	}
+
+	// the metrics of both instances are listed
+	c.SetClientFuncs(c.Region, &ClientFuncs{
+		ListMetrics: func(ctx context.Context, params *cloudwatch.ListMetricsInput) (*cloudwatch.ListMetricsOutput, error) {
+			metrics := []*cloudwatch.Metric{}
+			for _, id := range []string{"i-1", "i-2"} {
+				metrics = append(metrics, &cloudwatch.Metric{
+					Namespace:  params.Namespace,
+					MetricName: aws.String("CPUUtilization"),
+					Dimensions: []*cloudwatch.Dimension{
+						&cloudwatch.Dimension{Name: aws.String("InstanceId"), Value: aws.String(id)},
+					},
+				})
+			}
+			return &cloudwatch.ListMetricsOutput{Metrics: metrics}, nil
+		},
+	})
+	client := &mockResourceTagsClient{}
+	c.resourceTagsClients = map[string]resourceTagsClient{c.Region: client}
+
+	metrics, err := SelectMetrics(c)
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, "i-2", *metrics[0].Dimensions[0].Value)
+
+	tagFilters := []*resourcegroupstaggingapi.TagFilter{
+		&resourcegroupstaggingapi.TagFilter{Key: aws.String("env"), Values: aws.StringSlice([]string{"prod"})},
+	}
+	assert.Equal(t, tagFilters, client.tagFilters)
+	assert.Equal(t, 2, client.calls)
+
+	// the matching resources are not fetched again until refreshed
+	_, err = SelectMetrics(c)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, client.calls)
+}
+
+type mockFailingResourceTagsClient struct {
+	mockResourceTagsClient
+	fail bool
+}
+
+func (m *mockFailingResourceTagsClient) GetResourcesWithContext(ctx aws.Context, params *resourcegroupstaggingapi.GetResourcesInput, opts ...request.Option) (*resourcegroupstaggingapi.GetResourcesOutput, error) {
+	if m.fail {
+		m.calls++
+		return nil, errors.New("throttled")
+	}
+	return m.mockResourceTagsClient.GetResourcesWithContext(ctx, params, opts...)
+}
+
+func TestSelectMetricsResourceTagFiltersRefreshError(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "AWS/EC2",
+		RateLimit: 10,
+		ResourceTagFilters: []*ResourceTagFilter{
+			&ResourceTagFilter{Key: "env", Values: []string{"prod"}},
+		},
+	}
+
+	c.SetClientFuncs(c.Region, &ClientFuncs{
+		ListMetrics: func(ctx context.Context, params *cloudwatch.ListMetricsInput) (*cloudwatch.ListMetricsOutput, error) {
+			metrics := []*cloudwatch.Metric{}
+			for _, id := range []string{"i-1", "i-2"} {
+				metrics = append(metrics, &cloudwatch.Metric{
+					Namespace:  params.Namespace,
+					MetricName: aws.String("CPUUtilization"),
+					Dimensions: []*cloudwatch.Dimension{
+						&cloudwatch.Dimension{Name: aws.String("InstanceId"), Value: aws.String(id)},
+					},
+				})
+			}
+			return &cloudwatch.ListMetricsOutput{Metrics: metrics}, nil
+		},
+	})
+	client := &mockFailingResourceTagsClient{fail: true}
+	c.resourceTagsClients = map[string]resourceTagsClient{c.Region: client}
+
+	// selecting fails when the resources were never fetched
+	_, err := SelectMetrics(c)
+	assert.Error(t, err)
+
+	client.fail = false
+	metrics, err := SelectMetrics(c)
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 1)
+
+	// but keeps the resources fetched before when refreshing them fails, the
+	// refresh being requested once for all the metrics of the region
+	client.fail = true
+	client.calls = 0
+	metrics, err = SelectMetrics(c)
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, "i-2", *metrics[0].Dimensions[0].Value)
+	assert.Equal(t, 1, client.calls)
+}
+
+func TestMetricResolveARN(t *testing.T) {
+	m := &Metric{ARN: "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/web/73e2d6bc24d8a067"}
+	assert.NoError(t, m.resolveARN())
+	assert.Equal(t, []*Dimension{&Dimension{Name: "TargetGroup", Value: "targetgroup/web/73e2d6bc24d8a067"}}, m.Dimensions)
+	assert.Equal(t, "us-east-1", m.arnRegion)
+
+	// resolving again keeps the dimension once
+	assert.NoError(t, m.resolveARN())
+	assert.Len(t, m.Dimensions, 1)
+
+	m = &Metric{
+		ARN:        "arn:aws:rds:us-east-1:123456789012:db:orders",
+		Dimensions: []*Dimension{&Dimension{Name: "DBInstanceIdentifier", Value: "users"}},
+	}
+	assert.Error(t, m.resolveARN())
+
+	m = &Metric{ARN: "arn:aws:s3:::bucket"}
+	assert.Error(t, m.resolveARN())
+}
+
+func TestResourceDimension(t *testing.T) {
+	tests := []struct {
+		arn   string
+		name  string
+		value string
+	}{
+		{"arn:aws:ec2:us-east-1:123456789012:instance/i-1", "InstanceId", "i-1"},
+		{"arn:aws-cn:ec2:cn-north-1:123456789012:instance/i-1", "InstanceId", "i-1"},
+		{"arn:aws:ec2:us-east-1:123456789012:volume/vol-1", "VolumeId", "vol-1"},
+		{"arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/web/50dc6c495c0c9188", "LoadBalancer", "app/web/50dc6c495c0c9188"},
+		{"arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/web", "LoadBalancerName", "web"},
+		{"arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/web/73e2d6bc24d8a067", "TargetGroup", "targetgroup/web/73e2d6bc24d8a067"},
+		{"arn:aws:rds:us-east-1:123456789012:db:orders", "DBInstanceIdentifier", "orders"},
+		{"arn:aws:sqs:us-east-1:123456789012:jobs", "QueueName", "jobs"},
+		{"arn:aws:dynamodb:us-east-1:123456789012:table/users", "TableName", "users"},
+		{"arn:aws:lambda:us-east-1:123456789012:function:resize", "FunctionName", "resize"},
+	}
+
+	for _, tt := range tests {
+		name, value, ok := resourceDimension(tt.arn)
+		assert.True(t, ok, tt.arn)
+		assert.Equal(t, tt.name, name, tt.arn)
+		assert.Equal(t, tt.value, value, tt.arn)
+	}
+
+	// resources without a known dimension are not matched
+	_, _, ok := resourceDimension("arn:aws:s3:::bucket")
+	assert.False(t, ok)
+	_, _, ok = resourceDimension("not-an-arn")
+	assert.False(t, ok)
+}
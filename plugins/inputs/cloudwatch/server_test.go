@@ -0,0 +1,156 @@
+package cloudwatch
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCloudWatchServer serves the CloudWatch query API from the canned
+// responses of testdata, recording the parameters of every request. The
+// listing is returned in two pages, whatever the requested filters.
+type fakeCloudWatchServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []url.Values
+}
+
+func newFakeCloudWatchServer(t *testing.T) *fakeCloudWatchServer {
+	s := &fakeCloudWatchServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("invalid request: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, r.PostForm)
+		s.mu.Unlock()
+
+		var fixture string
+		switch r.PostForm.Get("Action") {
+		case "ListMetrics":
+			fixture = "list_metrics_1.xml"
+			if r.PostForm.Get("NextToken") == "page-2" {
+				fixture = "list_metrics_2.xml"
+			}
+		case "GetMetricStatistics":
+			fixture = "get_metric_statistics.xml"
+		default:
+			t.Errorf("unexpected action %q", r.PostForm.Get("Action"))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		body, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Errorf("missing fixture: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write(body)
+	}))
+	return s
+}
+
+// actionRequests returns the parameters of the requests of given action.
+func (s *fakeCloudWatchServer) actionRequests(action string) []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	requests := []url.Values{}
+	for _, params := range s.requests {
+		if params.Get("Action") == action {
+			requests = append(requests, params)
+		}
+	}
+	return requests
+}
+
+func TestGatherFakeServer(t *testing.T) {
+	server := newFakeCloudWatchServer(t)
+	defer server.Close()
+
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:      "us-east-1",
+		AccessKey:   "AKIDEXAMPLE",
+		SecretKey:   "secret",
+		EndpointURL: server.URL,
+		Namespace:   "AWS/ELB",
+		Delay:       internalDuration,
+		Period:      internalDuration,
+		RateLimit:   10,
+		Statistics:  []string{"Average", "Sum"},
+		Metrics: []*Metric{
+			&Metric{
+				MetricNames: []string{"Latency", "RequestCount"},
+				Dimensions: []*Dimension{
+					&Dimension{Name: "LoadBalancerName", Value: "p-*"},
+				},
+			},
+		},
+	}
+
+	var acc testutil.Accumulator
+	assert.NoError(t, c.Gather(&acc))
+
+	// both pages are listed once, filtered by dimension name
+	listings := server.actionRequests("ListMetrics")
+	assert.Len(t, listings, 2)
+	for _, params := range listings {
+		assert.Equal(t, "AWS/ELB", params.Get("Namespace"))
+		assert.Equal(t, "LoadBalancerName", params.Get("Dimensions.member.1.Name"))
+	}
+
+	// the metrics of the other load balancer, other dimensions or other
+	// names are not requested
+	requests := server.actionRequests("GetMetricStatistics")
+	assert.Len(t, requests, 2)
+	names := []string{}
+	for _, params := range requests {
+		names = append(names, params.Get("MetricName"))
+		assert.Equal(t, "p-example", params.Get("Dimensions.member.1.Value"))
+		assert.Equal(t, "60", params.Get("Period"))
+	}
+	assert.Contains(t, names, "Latency")
+	assert.Contains(t, names, "RequestCount")
+
+	tags := map[string]string{}
+	tags["unit"] = "seconds"
+	tags["region"] = "us-east-1"
+	tags["load_balancer_name"] = "p-example"
+
+	// the metrics are gathered concurrently, in any order
+	assert.Len(t, acc.Metrics, 2)
+	fields := map[string]interface{}{}
+	for _, m := range acc.Metrics {
+		assert.Equal(t, "cloudwatch_aws_elb", m.Measurement)
+		assert.Equal(t, tags, m.Tags)
+		assert.Equal(t, time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC), m.Time.UTC())
+		for k, v := range m.Fields {
+			fields[k] = v
+		}
+	}
+
+	expected := map[string]interface{}{}
+	expected["latency_average"] = 0.25
+	expected["latency_sum"] = 42.5
+	expected["request_count_average"] = 0.25
+	expected["request_count_sum"] = 42.5
+	assert.Equal(t, expected, fields)
+}
@@ -0,0 +1,86 @@
+package cloudwatch
+
+import (
+	"github.com/influxdata/telegraf/selfstat"
+)
+
+// namespaceStats are the internal stats of a namespace of a region during
+// the last gather, recorded by the internal input in the internal_cloudwatch
+// measurement.
+type namespaceStats struct {
+	metricsGathered selfstat.Stat
+	apiCalls        selfstat.Stat
+	errors          selfstat.Stat
+}
+
+/*
+ * Register the internal stats of every region and of its configured
+ * namespaces, once the regions are resolved
+ */
+func (c *CloudWatch) registerStats() {
+	namespaces := c.Namespaces
+	if c.Namespace != "" && !contains(namespaces, c.Namespace) {
+		namespaces = append([]string{c.Namespace}, namespaces...)
+	}
+	// metric math requests are counted apart from the namespaces
+	if len(c.MetricMath) > 0 {
+		namespaces = append(namespaces, metricMathMeasurement)
+	}
+
+	c.stats = map[string]map[string]*namespaceStats{}
+	c.emptyStats = map[string]selfstat.Stat{}
+	for _, region := range c.regions() {
+		c.emptyStats[region] = selfstat.Register("cloudwatch", "gather_empty", map[string]string{
+			"region": region,
+		})
+		c.stats[region] = map[string]*namespaceStats{}
+		for _, namespace := range namespaces {
+			tags := map[string]string{
+				"namespace": namespace,
+				"region":    region,
+			}
+			c.stats[region][namespace] = &namespaceStats{
+				metricsGathered: selfstat.Register("cloudwatch", "metrics_gathered", tags),
+				apiCalls:        selfstat.Register("cloudwatch", "api_calls", tags),
+				errors:          selfstat.Register("cloudwatch", "errors", tags),
+			}
+		}
+	}
+}
+
+/*
+ * Reset the internal stats at the start of a gather
+ */
+func (c *CloudWatch) resetStats() {
+	for _, namespaces := range c.stats {
+		for _, stats := range namespaces {
+			stats.metricsGathered.Set(0)
+			stats.apiCalls.Set(0)
+			stats.errors.Set(0)
+		}
+	}
+}
+
+/*
+ * Count the metrics gathered for given namespace of given region
+ */
+func (c *CloudWatch) countGathered(region, namespace string, n int) {
+	if stats, ok := c.stats[region][namespace]; ok {
+		stats.metricsGathered.Incr(int64(n))
+	}
+}
+
+/*
+ * Count an API request made for given namespace of given region, along with
+ * its error if any
+ */
+func (c *CloudWatch) countAPICall(region, namespace string, err error) {
+	stats, ok := c.stats[region][namespace]
+	if !ok {
+		return
+	}
+	stats.apiCalls.Incr(1)
+	if err != nil {
+		stats.errors.Incr(1)
+	}
+}
@@ -0,0 +1,124 @@
+package cloudwatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGatherStats(t *testing.T) {
+	duration, _ := time.ParseDuration("1m")
+	internalDuration := internal.Duration{
+		Duration: duration,
+	}
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "Custom/Stats",
+		Delay:     internalDuration,
+		Period:    internalDuration,
+		CacheTTL:  internal.Duration{Duration: time.Hour},
+		RateLimit: 10,
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockGatherCloudWatchClient{}}
+
+	assert.NoError(t, c.Gather(&acc))
+
+	// one ListMetrics and one GetMetricStatistics request
+	stats := c.stats["us-east-1"]["Custom/Stats"]
+	assert.EqualValues(t, 2, stats.apiCalls.Get())
+	assert.EqualValues(t, 0, stats.errors.Get())
+	assert.EqualValues(t, 1, stats.metricsGathered.Get())
+
+	// stats are reset every gather, the listing being cached
+	assert.NoError(t, c.Gather(&acc))
+	assert.EqualValues(t, 1, stats.apiCalls.Get())
+	assert.EqualValues(t, 1, stats.metricsGathered.Get())
+}
+
+func TestGatherStatsErrors(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Namespace: "Custom/StatsErrors",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 10,
+		Timeout:   internal.Duration{Duration: time.Millisecond},
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{c.Region: &mockHangingCloudWatchClient{}}
+
+	assert.Error(t, c.Gather(&acc))
+	assert.EqualValues(t, 1, c.stats["us-east-1"]["Custom/StatsErrors"].errors.Get())
+}
+
+func TestGatherStatsRegions(t *testing.T) {
+	c := &CloudWatch{
+		Region:    "us-east-1",
+		Regions:   []string{"us-west-2"},
+		Namespace: "Custom/StatsRegions",
+		Period:    internal.Duration{Duration: time.Minute},
+		RateLimit: 10,
+		Timeout:   internal.Duration{Duration: time.Millisecond},
+	}
+
+	var acc testutil.Accumulator
+	c.clients = map[string]cloudwatchClient{
+		"us-east-1": &mockGatherCloudWatchClient{},
+		"us-west-2": &mockHangingCloudWatchClient{},
+	}
+
+	assert.Error(t, c.Gather(&acc))
+
+	// every region counts its own requests, only the GetMetricStatistics
+	// request of us-west-2 timing out
+	east := c.stats["us-east-1"]["Custom/StatsRegions"]
+	west := c.stats["us-west-2"]["Custom/StatsRegions"]
+	assert.EqualValues(t, 2, east.apiCalls.Get())
+	assert.EqualValues(t, 0, east.errors.Get())
+	assert.EqualValues(t, 1, east.metricsGathered.Get())
+	assert.EqualValues(t, 2, west.apiCalls.Get())
+	assert.EqualValues(t, 1, west.errors.Get())
+	assert.EqualValues(t, 0, west.metricsGathered.Get())
+}
+
+func TestGatherStatsMetricData(t *testing.T) {
+	c := &CloudWatch{
+		Region:           "us-east-1",
+		Namespace:        "Custom/StatsMetricData",
+		Period:           internal.Duration{Duration: time.Minute},
+		CacheTTL:         internal.Duration{Duration: time.Hour},
+		RateLimit:        10,
+		UseGetMetricData: true,
+		MetricMath: []*MetricMath{
+			&MetricMath{ID: "total", Expression: "SUM(SEARCH('{Custom/StatsMetricData} MetricName=Latency', 'Sum', 60))"},
+		},
+	}
+
+	var acc testutil.Accumulator
+	client := &mockFailingMetricMathCloudWatchClient{}
+	c.clients = map[string]cloudwatchClient{c.Region: client}
+
+	// one ListMetrics and one GetMetricData request, the failed metric math
+	// request being counted on its own
+	assert.Error(t, c.Gather(&acc))
+	stats := c.stats["us-east-1"]["Custom/StatsMetricData"]
+	assert.EqualValues(t, 2, stats.apiCalls.Get())
+	assert.EqualValues(t, 0, stats.errors.Get())
+	assert.EqualValues(t, 1, stats.metricsGathered.Get())
+	math := c.stats["us-east-1"][metricMathMeasurement]
+	assert.EqualValues(t, 1, math.apiCalls.Get())
+	assert.EqualValues(t, 1, math.errors.Get())
+
+	// and the errors of GetMetricData requests are counted, the listing being
+	// cached
+	client.failMetrics = true
+	assert.Error(t, c.Gather(&acc))
+	assert.EqualValues(t, 1, stats.apiCalls.Get())
+	assert.EqualValues(t, 1, stats.errors.Get())
+	assert.EqualValues(t, 0, stats.metricsGathered.Get())
+}
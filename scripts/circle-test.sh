@@ -31,6 +31,8 @@ function check_go_fmt {
 # Set up the build directory, and then GOPATH.
 exit_if_fail mkdir $BUILD_DIR
 export GOPATH=$BUILD_DIR
+# Dependencies are restored from Godeps into GOPATH, not resolved as modules
+export GO111MODULE=off
 # Turning off GOGC speeds up build times
 export GOGC=off
 export PATH=$GOPATH/bin:$PATH